@@ -0,0 +1,63 @@
+package pcx
+
+import (
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// A Resampler scales src to a new image of the given width and height.
+type Resampler func(src image.Image, width, height int) image.Image
+
+// NearestNeighbor is a Resampler that copies the source pixel nearest to the
+// center of each destination pixel. Paletted and grayscale images keep their
+// type and palette; other images are returned as *image.RGBA.
+func NearestNeighbor(src image.Image, width, height int) image.Image {
+	r := image.Rect(0, 0, width, height)
+	var dst draw.Image
+	switch s := src.(type) {
+	case *image.Paletted:
+		dst = image.NewPaletted(r, s.Palette)
+	case *image.Gray:
+		dst = image.NewGray(r)
+	default:
+		dst = image.NewRGBA(r)
+	}
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		sy := b.Min.Y + (2*y+1)*b.Dy()/(2*height)
+		for x := 0; x < width; x++ {
+			sx := b.Min.X + (2*x+1)*b.Dx()/(2*width)
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// DecodeCorrectedAspect reads a PCX image from r and, if its horizontal and
+// vertical resolution differ, scales up the axis with the lower resolution
+// so that the image has square pixels and the proportions stored in the
+// file. A 640x200 image at 150x75 DPI, for example, is returned as 640x400.
+// Images with square pixels or without a stored resolution are returned as
+// decoded. A nil resample uses NearestNeighbor.
+func DecodeCorrectedAspect(r io.Reader, resample Resampler) (image.Image, error) {
+	m, meta, err := DecodeWithOptions(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	h, v := meta.Header.HorizDPI, meta.Header.VertDPI
+	if h == 0 || v == 0 || h == v {
+		return m, nil
+	}
+	if resample == nil {
+		resample = NearestNeighbor
+	}
+	width, height := m.Bounds().Dx(), m.Bounds().Dy()
+	if h < v {
+		width = int(math.Round(float64(width) * float64(v) / float64(h)))
+	} else {
+		height = int(math.Round(float64(height) * float64(h) / float64(v)))
+	}
+	return resample(m, width, height), nil
+}
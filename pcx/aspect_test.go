@@ -0,0 +1,55 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeCorrectedAspect(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	m := image.NewPaletted(image.Rect(0, 0, 640, 200), pal)
+	for x := 0; x < 640; x++ {
+		m.SetColorIndex(x, 199, 1)
+	}
+	for _, tc := range []struct {
+		horiz, vert   int
+		width, height int
+	}{
+		{150, 75, 640, 400},
+		{75, 150, 1280, 200},
+		{72, 72, 640, 200},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, m, &EncodeOptions{HorizDPI: tc.horiz, VertDPI: tc.vert}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := DecodeCorrectedAspect(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != image.Pt(tc.width, tc.height) {
+			t.Errorf("%dx%d DPI: size %v, want %dx%d", tc.horiz, tc.vert, got, tc.width, tc.height)
+			continue
+		}
+		if _, ok := img.(*image.Paletted); !ok {
+			t.Errorf("%dx%d DPI: got %T, want *image.Paletted", tc.horiz, tc.vert, img)
+		}
+		if !sameColor(img.At(0, tc.height-1), color.White) || !sameColor(img.At(0, tc.height-3), color.Black) {
+			t.Errorf("%dx%d DPI: bottom row not scaled", tc.horiz, tc.vert)
+		}
+
+		called := false
+		resample := func(src image.Image, width, height int) image.Image {
+			called = true
+			return NearestNeighbor(src, width, height)
+		}
+		if _, err := DecodeCorrectedAspect(bytes.NewReader(buf.Bytes()), resample); err != nil {
+			t.Fatal(err)
+		}
+		if called != (tc.horiz != tc.vert) {
+			t.Errorf("%dx%d DPI: resampler called %t", tc.horiz, tc.vert, called)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// dcxMagic identifies a DCX file, a multi-page container of PCX images used
+// by fax software. It is followed by a table of up to maxDCXPages page
+// offsets terminated by a zero offset.
+const dcxMagic = 0x3ade68b1
+
+// maxDCXPages is the number of pages a DCX file can hold.
+const maxDCXPages = 1023
+
+// DecodeDCX reads the pages of a DCX file from r.
+func DecodeDCX(r io.Reader) ([]image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != dcxMagic {
+		return nil, FormatError("not a DCX file")
+	}
+	br := bytes.NewReader(data)
+	var pages []image.Image
+	for i := 4; ; i += 4 {
+		if len(pages) > maxDCXPages || i+4 > len(data) {
+			return nil, FormatError("unterminated DCX page table")
+		}
+		off := binary.LittleEndian.Uint32(data[i:])
+		if off == 0 {
+			return pages, nil
+		}
+		if int64(off) >= int64(len(data)) {
+			return nil, FormatError("DCX page offset out of range")
+		}
+		m, err := DecodeAt(br, int64(off))
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, m)
+	}
+}
+
+// decodeFirstDCXPage decodes the first page of the DCX file in r, reading
+// only the start of the page table and that page.
+func decodeFirstDCXPage(r io.ReaderAt) (image.Image, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, FormatError("not a DCX file")
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) != dcxMagic {
+		return nil, FormatError("not a DCX file")
+	}
+	off := binary.LittleEndian.Uint32(hdr[4:])
+	if off == 0 {
+		return nil, errors.New("pcx: DCX file has no pages")
+	}
+	return DecodeAt(r, int64(off))
+}
+
+// EncodeDCX writes pages to w as a DCX file, each page encoded like Encode.
+func EncodeDCX(w io.Writer, pages []image.Image) error {
+	if len(pages) > maxDCXPages {
+		return errors.New("pcx: too many pages for DCX")
+	}
+	table := make([]byte, 4*(1+maxDCXPages+1))
+	binary.LittleEndian.PutUint32(table, dcxMagic)
+	var body bytes.Buffer
+	for i, m := range pages {
+		binary.LittleEndian.PutUint32(table[4+4*i:], uint32(len(table)+body.Len()))
+		if err := Encode(&body, m); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(table); err != nil {
+		return err
+	}
+	_, err := body.WriteTo(w)
+	return err
+}
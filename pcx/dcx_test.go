@@ -0,0 +1,39 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDCX(t *testing.T) {
+	pages := []image.Image{
+		image.NewGray(image.Rect(0, 0, 3, 2)),
+		image.NewPaletted(image.Rect(0, 0, 5, 5), color.Palette{color.Black, color.White}),
+		image.NewRGBA(image.Rect(0, 0, 1, 7)),
+	}
+	var buf bytes.Buffer
+	if err := EncodeDCX(&buf, pages); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeDCX(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pages) {
+		t.Fatalf("decoded %d pages, want %d", len(got), len(pages))
+	}
+	for i, m := range got {
+		if m.Bounds() != pages[i].Bounds() {
+			t.Errorf("page %d: bounds %v, want %v", i, m.Bounds(), pages[i].Bounds())
+		}
+	}
+
+	if _, err := DecodeDCX(bytes.NewReader(buf.Bytes()[4:])); err == nil {
+		t.Error("expected error for missing magic")
+	}
+	if _, err := DecodeDCX(bytes.NewReader(buf.Bytes()[:16])); err == nil {
+		t.Error("expected error for truncated page table")
+	}
+}
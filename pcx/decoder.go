@@ -7,11 +7,16 @@ package pcx
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
+	"math"
 )
 
 // Version:
@@ -32,6 +37,8 @@ const (
 
 type decoder struct {
 	r                io.Reader
+	br               byteReader // reads r once decoding past the header
+	ctx              context.Context
 	version          int
 	rle              bool
 	bpp              int
@@ -47,8 +54,255 @@ type decoder struct {
 	grayscale        bool
 	pb4              bool
 	colorModel       color.Model
+	palette          color.Palette // preset extended palette, skips reading it
+	dst              draw.Image    // image from DecodeOptions.NewImage
+	buffered         bool          // dst is filled once decoding completes
+	opts             DecodeOptions
+	meta             Metadata
+	repairs          Repairs // deviations tolerated while decoding
+	prefixed         []byte  // scanline data for ScanlineLengthPrefix
+	prefixedR        bytes.Reader
+	skipRows         int               // scanlines preceding the extended palette not decoded
+	seeked           bool              // palette was read ahead by seekPalette
+	lr               *io.LimitedReader // enforces DecodeOptions.MaxBytesRead
 }
 
+// DecodeOptions controls optional decoder behavior. The zero value decodes
+// exactly like Decode.
+type DecodeOptions struct {
+	// Checksums requests the CRC-32 of every decoded scanline in
+	// Metadata.Checksums.
+	Checksums bool
+
+	// Strict rejects files that deviate from the specification in ways the
+	// decoder otherwise tolerates, such as stray bytes before the extended
+	// palette or an unknown version byte.
+	Strict bool
+
+	// Trailer captures any data following the image in Metadata.Trailer and
+	// parses it into Metadata.Chunks when it is made up of chunks.
+	Trailer bool
+
+	// Transparency reads the trailer as if Trailer were set and, if it holds
+	// a TransparencyTag chunk, makes that entry of the palette of a decoded
+	// *image.Paletted fully transparent.
+	Transparency bool
+
+	// MaxBytesRead, if positive, limits the number of bytes read following
+	// the header. Decoding fails with ErrReadLimit if the image needs more.
+	// The trailer runs to the end of the input, so reading it fails if it
+	// reaches the limit.
+	MaxBytesRead int64
+
+	// ReadBufferSize is the size of the buffer that readers which cannot
+	// read single bytes efficiently are wrapped in, for the whole decode.
+	// Larger buffers make fewer reads from slow readers such as network
+	// connections. The default is 4096 bytes.
+	ReadBufferSize int
+
+	// NewImage, if set, creates the image to decode into instead of one of
+	// the standard library image types. It receives the image bounds and the
+	// color model of the file, a color.Palette for paletted files. Pixels are
+	// stored with SetColorIndex if the image provides it and Set otherwise.
+	// Without SetColorIndex, the pixels of 8bpp files are buffered until the
+	// extended palette following them is read, unless the reader is an
+	// io.ReadSeeker and the palette can be read from its end first.
+	NewImage func(bounds image.Rectangle, model color.Model) draw.Image
+
+	// PlaneStride, if positive, overrides the offset between the planes of
+	// a truecolor scanline, which is normally the bytes per line. Some
+	// malformed files pack their planes back to back with a stride of the
+	// image width.
+	PlaneStride int
+
+	// VGA6Bit scales palette components from the 0-63 range of the VGA
+	// hardware, which some old files store verbatim, to 0-255.
+	VGA6Bit bool
+
+	// RLEThreshold is the smallest byte value that starts a run, with the
+	// run length in the bits below its highest clear bit. Standard files
+	// always use 0xc0, the default; some PCX-like variants use 0x80, leaving
+	// 7 bits for the length. It must be 0x80, 0xc0, 0xe0 or 0xf0.
+	RLEThreshold byte
+
+	// DetectCompression salvages files whose header misstates whether the
+	// pixel data is run-length encoded: if decoding as the header says
+	// fails, the file is decoded again with the opposite compression, and
+	// Metadata.Header.RLE reports the compression that worked. The whole
+	// file is buffered in memory.
+	DetectCompression bool
+
+	// FlipVertical stores scanlines bottom-to-top in the returned image, for
+	// files written by tools that emit rows in reverse order.
+	FlipVertical bool
+
+	// Palette, if set, is used as the 256 color extended palette of 8bpp
+	// files instead of the one stored in the file, which is then neither
+	// allocated nor, unless VerifyPalette or the trailer is requested, read.
+	// Decoding a batch of files that share a palette can then share one
+	// color.Palette. The palette is not modified.
+	Palette color.Palette
+
+	// VerifyPalette reads the extended palette of files decoded with Palette
+	// and fails with a FormatError if it differs from Palette.
+	VerifyPalette bool
+
+	// PreferPalette decodes 8bpp single plane files flagged as grayscale as
+	// paletted, using the extended palette if one follows the pixel data,
+	// since some tools flag color files as grayscale. The result is an
+	// *image.Paletted, with a gray ramp palette if the file has none.
+	PreferPalette bool
+
+	// FourthPlane selects how the fourth plane of 8bpp 4-plane files is
+	// interpreted. Nothing in the header distinguishes the alternatives, so
+	// the default is FourthPlaneAlpha for all versions, including the
+	// version 5 files of Publisher's Paintbrush that use it otherwise.
+	FourthPlane FourthPlane
+
+	// ChannelMap assigns the planes of 8bpp truecolor files to output
+	// channels: plane p is decoded as channel ChannelMap[p], where 0 to 3
+	// are red, green, blue and the fourth plane's channel as interpreted by
+	// FourthPlane. The entries for the planes of a file must be a
+	// permutation of its channels, except that a last entry of 0 keeps the
+	// fourth plane in place, so a mapping for 3-plane files also applies to
+	// 4-plane ones. The zero value maps every plane to itself.
+	// FourthPlaneCMYK ignores it.
+	ChannelMap [4]int
+
+	// SkipBytes is the number of bytes following the header to discard
+	// before the pixel data, for devices that write junk there.
+	SkipBytes int
+
+	// LeadingPalette skips the copy of the extended palette that
+	// EncodeOptions.LeadingPalette writes directly after the header, if the
+	// pixel data starts with the palette magic. The copy cannot be told from
+	// pixel data starting with a literal of index 12, so it is only looked
+	// for when set.
+	LeadingPalette bool
+
+	// ScanlineLengthPrefix reads each scanline as a 16-bit little-endian
+	// count of its encoded bytes followed by that many bytes, a layout
+	// written by some nonstandard tools.
+	ScanlineLengthPrefix bool
+
+	// ExclusiveMax reads the maximum coordinates of the header window as
+	// exclusive rather than inclusive, for tools that store them off by
+	// one. Such files otherwise decode a pixel too wide and too tall, with
+	// a garbage last column and row.
+	ExclusiveMax bool
+
+	// UsePlanes, if 3 or 4, decodes 8bpp files with at least that many
+	// planes from their first UsePlanes planes as RGB or RGBA and ignores the
+	// rest, such as the extra layers or masks of some editors. Files with
+	// more than 4 planes are otherwise rejected.
+	UsePlanes int
+
+	// AutoTrim crops uniform borders, such as those left by scanners, from
+	// the decoded image and reports the bounds kept in Metadata.Trim. The
+	// border color is TrimColor or, if that is nil, the color of the
+	// corners when all four agree.
+	AutoTrim  bool
+	TrimColor color.Color
+}
+
+// FourthPlane selects the meaning of the fourth plane of 8bpp 4-plane files.
+type FourthPlane int
+
+const (
+	// FourthPlaneAlpha treats the planes as red, green, blue and alpha.
+	FourthPlaneAlpha FourthPlane = iota
+	// FourthPlaneOpaque ignores the fourth plane.
+	FourthPlaneOpaque
+	// FourthPlaneIntensity scales the red, green and blue planes by the
+	// fourth plane.
+	FourthPlaneIntensity
+	// FourthPlaneCMYK treats the planes as cyan, magenta, yellow and key and
+	// decodes them into an *image.CMYK.
+	FourthPlaneCMYK
+)
+
+// Header holds the fields of the 128 byte PCX file header.
+type Header struct {
+	Version         int
+	RLE             bool
+	BitsPerPixel    int
+	Window          image.Rectangle // image bounds with an exclusive Max
+	HorizDPI        int
+	VertDPI         int
+	Colormap        [48]byte // 16 color EGA palette
+	Planes          int
+	BytesPerLine    int
+	PaletteInfo     int // 1 for color or monochrome, 2 for grayscale
+	HorizScreenSize int
+	VertScreenSize  int
+
+	// Reserved holds reserved bytes 64, between the colormap and the plane
+	// count, and 69, which is also the high byte of PaletteInfo. The
+	// reserved bytes 74 to 127 are in Filler.
+	Reserved [2]byte
+
+	// Filler holds bytes 74 to 127, which the specification reserves and
+	// leaves zero but some tools use for their own purposes.
+	Filler [54]byte
+}
+
+// Metadata describes a decoded PCX image beyond its pixels.
+type Metadata struct {
+	// Header is the parsed file header.
+	Header Header
+
+	// Checksums holds the IEEE CRC-32 of each scanline after RLE decoding,
+	// covering all planes including any padding bytes, in file order. It is
+	// only set when DecodeOptions.Checksums is true.
+	Checksums []uint32
+
+	// Trailer holds the data following the pixel data and extended palette.
+	// It is only set when DecodeOptions.Trailer or Transparency is true.
+	Trailer []byte
+
+	// Chunks holds the chunks parsed from Trailer if it consists entirely of
+	// chunks in the layout described by Chunk.
+	Chunks []Chunk
+
+	// Properties holds the key/value pairs of a PropertiesTag chunk, such as
+	// those written by EncodeOptions.Properties.
+	Properties map[string]string
+
+	// Cycles holds the palette cycling ranges of a CyclesTag chunk, such as
+	// those written by EncodeOptions.Cycles.
+	Cycles []CycleRange
+
+	// Transparent reports whether the trailer holds a TransparencyTag chunk,
+	// such as one written by EncodeOptions.Transparent, naming the
+	// transparent palette index TransparentIndex.
+	Transparent      bool
+	TransparentIndex uint8
+
+	// PaletteLength is the number of colors recorded in a PaletteLengthTag
+	// chunk, such as one written by EncodeOptions.KeepPaletteLength, or 0.
+	// A decoded *image.Paletted has its palette truncated to that length.
+	PaletteLength int
+
+	// Trim is the part of the image kept by DecodeOptions.AutoTrim, which
+	// is empty if the whole image is border.
+	Trim image.Rectangle
+}
+
+// SourceColors returns the number of distinct colors the file could store: 2,
+// 4, 8, 16 or 256 for paletted and grayscale files, or -1 for truecolor files.
+// It describes the file rather than the decoded image, which may use a wider
+// color model.
+func (m *Metadata) SourceColors() int {
+	if bits := m.Header.BitsPerPixel * m.Header.Planes; bits <= 8 {
+		return 1 << uint(bits)
+	}
+	return -1
+}
+
+// ErrReadLimit is returned when decoding an image needs more input than
+// DecodeOptions.MaxBytesRead allows.
+var ErrReadLimit = errors.New("pcx: read limit exceeded")
+
 // A FormatError reports that the input is not a valid PCX.
 type FormatError string
 
@@ -82,6 +336,9 @@ var cga16ColorPalette = [16]color.Color{
 	color.RGBA{0xff, 0xff, 0xff, 0xff}, // 15 white
 }
 
+// cga4ColorPalettes holds the foreground colors of the CGA 4 color modes,
+// indexed by the top three bits of the fourth colormap byte of files written
+// before PC Paintbrush 4.0: color burst disabled, palette and intensity.
 var cga4ColorPalettes = [8][]color.Color{
 	{cga16ColorPalette[2], cga16ColorPalette[4], cga16ColorPalette[6]},    // green, red, brown
 	{cga16ColorPalette[10], cga16ColorPalette[12], cga16ColorPalette[14]}, // light green, light red, yellow
@@ -94,12 +351,52 @@ var cga4ColorPalettes = [8][]color.Color{
 }
 
 func init() {
-	// The magic also matches the RLE bit to make sure it's set
+	// The magic also matches the encoding byte, which must be 0 or 1, to
+	// keep false positives down for the single byte 0x0a. DecodeConfig and
+	// Decode themselves accept either encoding.
 	image.RegisterFormat("pcx", "\x0a?\x01", Decode, DecodeConfig)
+	image.RegisterFormat("pcx", "\x0a?\x00", Decode, DecodeConfig)
+}
+
+// Sniff reports whether b, which should hold at least the first 128 bytes of
+// a file, plausibly starts with a PCX header. Besides the magic byte it checks
+// the version, encoding, bit depth, plane count and dimensions, so it
+// misdetects other formats far less often than the magic registered with the
+// image package.
+func Sniff(b []byte) bool {
+	if len(b) < 128 || b[0] != magic {
+		return false
+	}
+	switch b[1] {
+	case 0, 2, 3, 4, 5:
+	default:
+		return false
+	}
+	bpp, nplanes := int(b[3]), int(b[65])
+	if b[2] > 1 || bpp < 1 || bpp > 8 || nplanes < 1 || nplanes > 4 {
+		return false
+	}
+	minX := int(b[4]) | int(b[5])<<8
+	maxX := int(b[8]) | int(b[9])<<8
+	if minX > maxX {
+		minX, maxX = int(int16(minX)), int(int16(maxX))
+	}
+	minY := int(b[6]) | int(b[7])<<8
+	maxY := int(b[10]) | int(b[11])<<8
+	if minY > maxY {
+		minY, maxY = int(int16(minY)), int(int16(maxY))
+	}
+	if maxX < minX || maxY < minY {
+		return false
+	}
+	bytesPerLine := int(b[66]) | int(b[67])<<8
+	return bytesPerLine*8 >= (maxX-minX+1)*bpp
 }
 
 // Decode reads a PCX image from r and returns it as an image.Image.
-// The type of Image returned depends on the PCX contents.
+// The type of Image returned depends on the PCX contents. If r implements
+// io.ByteReader, exactly the header, pixel data and extended palette are
+// read from it; otherwise r may be read past the end of the image.
 func Decode(r io.Reader) (image.Image, error) {
 	d, err := newDecoder(r)
 	if err != nil {
@@ -112,8 +409,168 @@ func Decode(r io.Reader) (image.Image, error) {
 	return img, nil
 }
 
+// DecodeGray reads a PCX image from r and returns it converted to grayscale
+// with the Rec. 601 luma weights of color.GrayModel. Color images are
+// converted a scanline at a time, without a full color intermediate.
+func DecodeGray(r io.Reader) (*image.Gray, error) {
+	opts := &DecodeOptions{
+		NewImage: func(b image.Rectangle, _ color.Model) draw.Image {
+			return image.NewGray(b)
+		},
+	}
+	m, _, err := DecodeWithOptions(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.(*image.Gray), nil
+}
+
+// DecodeStream decodes the PCX images stored back to back in r, such as
+// files concatenated without a container, until r is exhausted. Each image
+// must be followed directly by the next, with no trailing data.
+func DecodeStream(r io.Reader) ([]image.Image, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var imgs []image.Image
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return imgs, nil
+		} else if err != nil {
+			return imgs, err
+		}
+		m, err := Decode(br)
+		if err != nil {
+			return imgs, err
+		}
+		imgs = append(imgs, m)
+	}
+}
+
+// DecodeAt reads a PCX image embedded in r at the given offset, such as a
+// sprite stored inside a larger archive.
+func DecodeAt(r io.ReaderAt, offset int64) (image.Image, error) {
+	return Decode(io.NewSectionReader(r, offset, math.MaxInt64-offset))
+}
+
+// DecodeContext reads a PCX image from r like Decode, checking ctx before
+// every scanline and returning ctx.Err() once it is cancelled or its deadline
+// passes.
+func DecodeContext(ctx context.Context, r io.Reader) (image.Image, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	d.ctx = ctx
+	img, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// DecodeWithOptions reads a PCX image from r like Decode, honoring opts, and
+// returns the metadata gathered while decoding. A nil opts is equivalent to
+// the zero DecodeOptions.
+func DecodeWithOptions(r io.Reader, opts *DecodeOptions) (image.Image, *Metadata, error) {
+	if opts != nil && opts.DetectCompression {
+		return decodeDetectCompression(r, opts)
+	}
+	d, err := newDecoderWithOptions(r, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !validRLEThreshold(d.opts.RLEThreshold) {
+		return nil, nil, fmt.Errorf("pcx: invalid RLE threshold %#x", d.opts.RLEThreshold)
+	}
+	if d.opts.SkipBytes < 0 {
+		return nil, nil, fmt.Errorf("pcx: negative SkipBytes %d", d.opts.SkipBytes)
+	}
+	if u := d.opts.UsePlanes; u != 0 && u != 3 && u != 4 {
+		return nil, nil, fmt.Errorf("pcx: invalid UsePlanes %d", u)
+	}
+
+	img, err := d.decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, &d.meta, nil
+}
+
+// decodeDetectCompression buffers the file from r and decodes it with the
+// compression its header states and with the opposite one. An attempt that
+// succeeds and consumes exactly the file is preferred, since mislabeled data
+// can decode without error but leave bytes over.
+func decodeDetectCompression(r io.Reader, opts *DecodeOptions) (image.Image, *Metadata, error) {
+	o := *opts
+	o.DetectCompression = false
+	if o.MaxBytesRead > 0 {
+		r = io.LimitReader(r, 128+o.MaxBytesRead+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 128 || data[2] > 1 {
+		return DecodeWithOptions(bytes.NewReader(data), &o)
+	}
+	flipped := append([]byte(nil), data...)
+	flipped[2] ^= 1
+
+	// Try without reading the trailer, which would consume any leftover.
+	trial := o
+	trial.Trailer, trial.Transparency = false, false
+	best, exact := -1, false
+	for i, b := range [][]byte{data, flipped} {
+		br := bytes.NewReader(b)
+		if _, _, err := DecodeWithOptions(br, &trial); err != nil {
+			continue
+		}
+		if best < 0 || (!exact && br.Len() == 0) {
+			best, exact = i, br.Len() == 0
+		}
+	}
+	if best == 1 {
+		return DecodeWithOptions(bytes.NewReader(flipped), &o)
+	}
+	return DecodeWithOptions(bytes.NewReader(data), &o)
+}
+
+// SafeDecode decodes a PCX image from untrusted input. It rejects images of
+// more than maxPixels pixels after reading only the header, so memory use is
+// bounded by the pixel count, and it reads no more than the largest possible
+// encoding of an image of that size: twice the scanline bytes for RLE data,
+// plus the extended palette and the stray bytes tolerated before it. A
+// leading copy of the palette is not looked for, as if
+// DecodeOptions.LeadingPalette were unset, so it takes none of the budget.
+// Any trailing data is left unread. Out of range color indices are clamped
+// as by Decode.
+func SafeDecode(r io.Reader, maxPixels int) (image.Image, error) {
+	if maxPixels <= 0 {
+		return nil, fmt.Errorf("pcx: invalid pixel limit %d", maxPixels)
+	}
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	if w, h := d.bounds.Dx(), d.bounds.Dy(); h > 0 && w > maxPixels/h {
+		return nil, fmt.Errorf("pcx: image of %dx%d pixels exceeds the limit of %d", w, h, maxPixels)
+	}
+	n := int64(d.bytesPerScanline) * int64(d.bounds.Dy())
+	if d.rle {
+		n *= 2
+	}
+	// The budget has no room for a leading palette copy, which is left
+	// undetected.
+	d.opts.LeadingPalette = false
+	d.opts.MaxBytesRead = n + maxPaletteSkip + 1 + 3*256
+	return d.decode()
+}
+
 // DecodeConfig returns the color model and dimensions of a PCX image
-// without decoding the entire image.
+// without decoding the entire image. It only reads the header and accepts
+// files regardless of their encoding byte.
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	d, err := newDecoder(r)
 	if err != nil {
@@ -126,10 +583,79 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	}, nil
 }
 
+// ReadPalette returns the 256 color extended palette of an 8bpp PCX image
+// without decoding its pixels. If r is an io.ReadSeeker the palette is read
+// from the end of the stream, so files followed by trailer chunks or other
+// data must be passed as a plain io.Reader; otherwise, or if the end of the
+// stream holds no palette, the pixel data is read through.
+func ReadPalette(r io.Reader) (color.Palette, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	if !d.hasExtendedPalette() {
+		return nil, errors.New("pcx: image has no extended palette")
+	}
+	if s, ok := r.(io.ReadSeeker); ok {
+		pal, _, err := d.seekPalette(s)
+		if err != nil || pal != nil {
+			return pal, err
+		}
+	}
+	pal := make(color.Palette, 256)
+	bufR := d.newByteReader(r)
+	for y := 0; y < d.bounds.Dy(); y++ {
+		if err := d.decodeScanline(bufR, nil); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	if err := d.readExtendedPalette(bufR, pal); err != nil {
+		return nil, err
+	}
+	return pal, nil
+}
+
+// seekPalette reads what is probably the extended palette from the end of
+// s, where files without trailer chunks keep it, and restores the position of
+// s, which it returns. It returns a nil palette if there is none at the end.
+// The palette following the pixel data must still be checked against it.
+func (d *decoder) seekPalette(s io.ReadSeeker) (color.Palette, int64, error) {
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	var pal color.Palette
+	if _, err := s.Seek(-(1 + 3*256), io.SeekEnd); err == nil {
+		var buf [1 + 3*256]byte
+		if _, err := io.ReadFull(s, buf[:]); err == nil && buf[0] == paletteMagic {
+			pal = make(color.Palette, 256)
+			for i := range pal {
+				pal[i] = d.paletteColor(buf[1+i*3:])
+			}
+		}
+	}
+	if _, err := s.Seek(start, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return pal, start, nil
+}
+
 func newDecoder(r io.Reader) (*decoder, error) {
+	return newDecoderWithOptions(r, nil)
+}
+
+// newDecoderWithOptions is like newDecoder, but honors the options that
+// affect how the header is read.
+func newDecoderWithOptions(r io.Reader, opts *DecodeOptions) (*decoder, error) {
 	d := &decoder{
 		r: r,
 	}
+	if opts != nil {
+		d.opts = *opts
+	}
 	if err := d.readHeader(); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -139,6 +665,52 @@ func newDecoder(r io.Reader) (*decoder, error) {
 	return d, nil
 }
 
+// byteReader is the reader scanlines are decoded from.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// newByteReader returns r if it can already read single bytes efficiently,
+// such as a *bytes.Reader or *bufio.Reader, and a reader buffering r with
+// DecodeOptions.ReadBufferSize bytes otherwise.
+func (d *decoder) newByteReader(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	if d.opts.ReadBufferSize > 0 {
+		return bufio.NewReaderSize(r, d.opts.ReadBufferSize)
+	}
+	return bufio.NewReader(r)
+}
+
+// limitedByteReader reads single bytes from br, counting them against lr,
+// which reads from br as well.
+type limitedByteReader struct {
+	*io.LimitedReader
+	br byteReader
+}
+
+func (l *limitedByteReader) ReadByte() (byte, error) {
+	if l.N <= 0 {
+		return 0, io.EOF
+	}
+	b, err := l.br.ReadByte()
+	if err == nil {
+		l.N--
+	}
+	return b, err
+}
+
+// validVersion reports whether v is a version byte written by PC Paintbrush.
+func validVersion(v int) bool {
+	switch v {
+	case 0, 2, 3, 4, 5:
+		return true
+	}
+	return false
+}
+
 func (d *decoder) readHeader() error {
 	var buf [128]byte
 
@@ -150,6 +722,11 @@ func (d *decoder) readHeader() error {
 	if buf[0] != magic {
 		return FormatError("not a PCX file")
 	}
+	// The magic byte alone is common, so strictly the version byte that
+	// completes the ZSoft signature must be a known version too.
+	if d.opts.Strict && !validVersion(int(buf[1])) {
+		return FormatError(fmt.Sprintf("not a PCX file (version %d)", buf[1]))
+	}
 
 	d.version = int(buf[1])
 	d.rle = buf[2] == 1
@@ -161,15 +738,28 @@ func (d *decoder) readHeader() error {
 	for i := 0; i < 4; i++ {
 		dim[i] = int(buf[4+i*2]) | (int(buf[5+i*2]) << 8)
 	}
-	d.bounds = image.Rect(
-		int(buf[4])|(int(buf[5])<<8),
-		int(buf[6])|(int(buf[7])<<8),
-		int(buf[8])|(int(buf[9])<<8)+1,
-		int(buf[10])|(int(buf[11])<<8)+1)
+	// Tools that treat the window as signed write a negative minimum, which
+	// reads as a minimum past the maximum when unsigned.
+	for i := 0; i < 2; i++ {
+		if dim[i] > dim[i+2] {
+			dim[i] = int(int16(dim[i]))
+			dim[i+2] = int(int16(dim[i+2]))
+		}
+	}
+	d.bounds = image.Rect(dim[0], dim[1], dim[2]+1, dim[3]+1)
+	if d.opts.ExclusiveMax {
+		if d.bounds.Dx() < 2 || d.bounds.Dy() < 2 {
+			return FormatError("window too small for an exclusive maximum")
+		}
+		d.bounds.Max = d.bounds.Max.Sub(image.Pt(1, 1))
+	}
 	d.horizDpi = int(buf[12]) | (int(buf[13]) << 8)
 	d.vertDpi = int(buf[14]) | (int(buf[15]) << 8)
 	copy(d.colormap[:48], buf[16:16+48])
 	d.nplanes = int(buf[65])
+	if d.nplanes < 1 || d.nplanes > 8 {
+		return FormatError(fmt.Sprintf("invalid plane count (%d)", d.nplanes))
+	}
 	d.bytesPerLine = int(buf[66]) | (int(buf[67]) << 8)
 	d.bytesPerScanline = d.bytesPerLine * d.nplanes
 	d.grayscale = buf[68] == 2
@@ -180,6 +770,27 @@ func (d *decoder) readHeader() error {
 	if d.bytesPerScanline < (d.bounds.Dx()*d.bpp*d.nplanes+7)/8 {
 		return FormatError("corrupt image")
 	}
+	// Every plane must hold a full row, not just all planes together.
+	if d.bytesPerLine < (d.bounds.Dx()*d.bpp+7)/8 {
+		return FormatError(fmt.Sprintf("bytes per line (%d) too small for width %d", d.bytesPerLine, d.bounds.Dx()))
+	}
+
+	d.meta.Header = Header{
+		Version:         d.version,
+		RLE:             d.rle,
+		BitsPerPixel:    d.bpp,
+		Window:          d.bounds,
+		HorizDPI:        d.horizDpi,
+		VertDPI:         d.vertDpi,
+		Colormap:        d.colormap,
+		Planes:          d.nplanes,
+		BytesPerLine:    d.bytesPerLine,
+		PaletteInfo:     int(buf[68]) | (int(buf[69]) << 8),
+		HorizScreenSize: d.horizSize,
+		VertScreenSize:  d.vertSize,
+	}
+	d.meta.Header.Reserved = [2]byte{buf[64], buf[69]}
+	copy(d.meta.Header.Filler[:], buf[74:128])
 
 	if d.grayscale {
 		d.colorModel = color.GrayModel
@@ -191,107 +802,458 @@ func (d *decoder) readHeader() error {
 }
 
 func (d *decoder) decode() (image.Image, error) {
-	if !d.rle {
-		return nil, UnsupportedError("non-RLE")
+	// Decoding into a NewImage without color indices has to buffer the whole
+	// image until the palette is known, unless it can be read first. Options
+	// that depend on reading the palette in sequence rule that out.
+	o := &d.opts
+	s, ok := d.r.(io.ReadSeeker)
+	if ok && o.NewImage != nil && o.Palette == nil && d.palette == nil && d.hasExtendedPalette() &&
+		!o.Strict && !o.Trailer && !o.Transparency && o.MaxBytesRead == 0 {
+		pal, start, err := d.seekPalette(s)
+		if err != nil {
+			return nil, err
+		}
+		d.palette = pal
+		d.seeked = pal != nil
+		skipRows := d.skipRows
+		img, err := d.decodeBody()
+		if err == nil {
+			return img, nil
+		}
+		// The end of the stream held something else, such as a trailer
+		// chunk, so decode again with the palette that was read if there
+		// was one, or as usual.
+		if _, err := s.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err != errPaletteMismatch {
+			d.palette = nil
+		}
+		d.seeked = false
+		d.skipRows = skipRows
+		d.repairs = Repairs{}
+	}
+	return d.decodeBody()
+}
+
+// decodeBody decodes the image and trailer following the header.
+func (d *decoder) decodeBody() (image.Image, error) {
+	if d.opts.MaxBytesRead > 0 {
+		d.lr = &io.LimitedReader{R: d.r, N: d.opts.MaxBytesRead}
+		if br, ok := d.r.(byteReader); ok {
+			// Keep reading single bytes without buffering past the image.
+			d.br = &limitedByteReader{d.lr, br}
+		} else {
+			d.br = d.newByteReader(d.lr)
+		}
+	} else {
+		d.br = d.newByteReader(d.r)
+	}
+	if d.palette == nil && d.opts.Palette != nil && d.hasExtendedPalette() {
+		d.palette = d.opts.Palette
+	}
+
+	var img image.Image
+	_, err := io.CopyN(io.Discard, d.br, int64(d.opts.SkipBytes))
+	if err == nil && d.opts.LeadingPalette {
+		err = d.skipLeadingPalette()
+	}
+	if err == nil {
+		img, err = d.decodeImage()
+	}
+	if err != nil {
+		if d.limitReached() && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			err = ErrReadLimit
+		}
+		return img, err
+	}
+	if d.opts.Trailer || d.opts.Transparency {
+		if err := d.readTrailer(); err != nil {
+			return img, err
+		}
+		d.applyPaletteLength(img)
+	}
+	if d.opts.Transparency {
+		d.applyTransparency(img)
+	}
+	if d.opts.AutoTrim {
+		img = d.trim(img)
+	}
+	return img, nil
+}
+
+// skipLeadingPalette discards a copy of the extended palette directly after
+// the header if the pixel data starts with the palette magic.
+func (d *decoder) skipLeadingPalette() error {
+	gray := d.grayscale && d.bpp == 8 && d.nplanes == 1
+	if !(d.hasExtendedPalette() || gray) {
+		return nil
+	}
+	bs, ok := d.br.(io.ByteScanner)
+	if !ok {
+		br := bufio.NewReader(d.br)
+		d.br, bs = br, br
+	}
+	b, err := bs.ReadByte()
+	if err != nil {
+		// Left for decoding to report.
+		return nil
+	}
+	if b != paletteMagic {
+		return bs.UnreadByte()
 	}
+	_, err = io.CopyN(io.Discard, d.br, 3*256)
+	return err
+}
+
+// limitReached reports whether DecodeOptions.MaxBytesRead bytes have been
+// read, so that running out of input may be due to the limit.
+func (d *decoder) limitReached() bool {
+	return d.lr != nil && d.lr.N == 0
+}
 
+func (d *decoder) decodeImage() (image.Image, error) {
 	switch {
+	case d.preferPalette():
+		return d.decodeRGBPaletted()
 	case d.colorModel == color.GrayModel:
-		if d.bpp == 8 {
+		if d.bpp == 8 && d.nplanes == 1 {
 			return d.decodeGrayscale()
 		}
-		return nil, UnsupportedError("grayscale only supported with 8bpp")
+		return nil, UnsupportedError("grayscale only supported with 8bpp and 1 plane")
 	case d.nplanes == 1:
-		if d.bpp == 8 {
+		switch d.bpp {
+		case 8:
 			return d.decodeRGBPaletted()
+		case 1, 2, 4:
+			return d.decodePaletted()
 		}
-		return d.decodePaletted()
+	case d.bpp == 8 && d.opts.UsePlanes > 0 && d.nplanes >= d.opts.UsePlanes:
+		return d.decodeRGB()
 	case d.bpp == 8 && (d.nplanes == 3 || d.nplanes == 4):
 		return d.decodeRGB()
 	case d.bpp == 1 && (d.nplanes >= 2 && d.nplanes <= 4):
 		return d.decodePlanar()
+	case d.bpp == 2 && d.nplanes == 4:
+		return d.decodePlanar2bpp()
 	}
 
 	return nil, UnsupportedError(fmt.Sprintf("version %d with %d planes %d bpp", d.version, d.nplanes, d.bpp))
 }
 
 func (d *decoder) decodeGrayscale() (image.Image, error) {
-	bufR := bufio.NewReader(d.r)
-	img := image.NewGray(d.bounds)
+	bufR := d.br
+	d.newOutput(color.GrayModel)
+	img := image.NewGray(d.pixBounds())
+	width := d.bounds.Dx()
 	height := d.bounds.Dy()
+	buf := make([]byte, d.bytesPerScanline)
 	for y := 0; y < height; y++ {
-		if err := d.rleDecode(bufR, img.Pix[y*img.Stride:]); err != nil {
+		if err := d.readScanline(bufR, buf); err != nil {
 			return img, err
 		}
+		o := d.pixRow(y) * img.Stride
+		copy(img.Pix[o:o+width], buf)
+		d.storeRow(img, y)
 	}
-	return img, nil
+	return d.output(img), nil
 }
 
 func (d *decoder) decodeRGB() (image.Image, error) {
-	bufR := bufio.NewReader(d.r)
+	bufR := d.br
 
-	img := image.NewRGBA(d.bounds)
 	width := d.bounds.Dx()
 	height := d.bounds.Dy()
-	offset := 0
+	stride := d.bytesPerLine
+	if d.opts.PlaneStride > 0 {
+		stride = d.opts.PlaneStride
+		if stride*(d.nplanes-1)+width > d.bytesPerScanline {
+			return nil, FormatError(fmt.Sprintf("plane stride %d exceeds scanline", stride))
+		}
+	}
+	planes := d.colorPlanes()
+	if planes == 4 && d.opts.FourthPlane == FourthPlaneCMYK {
+		return d.decodeCMYK(stride)
+	}
+	off, err := d.channelOffsets(planes, stride)
+	if err != nil {
+		return nil, err
+	}
+	d.newOutput(color.RGBAModel)
+	img := image.NewRGBA(d.pixBounds())
 	buf := make([]byte, d.bytesPerScanline)
 	for y := 0; y < height; y++ {
-		if err := d.rleDecode(bufR, buf); err != nil {
+		if err := d.readScanline(bufR, buf); err != nil {
 			return img, err
 		}
+		offset := d.pixRow(y) * img.Stride
 		for x := 0; x < width; x++ {
-			img.Pix[offset] = buf[x]
-			img.Pix[offset+1] = buf[x+d.bytesPerLine]
-			img.Pix[offset+2] = buf[x+2*d.bytesPerLine]
-			if d.nplanes == 4 {
-				img.Pix[offset+3] = buf[x+3*d.bytesPerLine]
-			} else {
-				img.Pix[offset+3] = 255
+			r, g, b, a := buf[x+off[0]], buf[x+off[1]], buf[x+off[2]], uint8(255)
+			if planes == 4 {
+				v := buf[x+off[3]]
+				switch d.opts.FourthPlane {
+				case FourthPlaneAlpha:
+					a = v
+				case FourthPlaneIntensity:
+					r = uint8(uint(r) * uint(v) / 255)
+					g = uint8(uint(g) * uint(v) / 255)
+					b = uint8(uint(b) * uint(v) / 255)
+				}
 			}
+			img.Pix[offset] = r
+			img.Pix[offset+1] = g
+			img.Pix[offset+2] = b
+			img.Pix[offset+3] = a
 			offset += 4
 		}
+		d.storeRow(img, y)
 	}
-	return img, nil
+	return d.output(img), nil
+}
+
+// channelOffsets returns the offsets within a scanline of the planes holding
+// the red, green, blue and fourth channels, as DecodeOptions.ChannelMap
+// assigns them, for an image of the given number of planes each stride
+// bytes apart.
+func (d *decoder) channelOffsets(planes, stride int) ([4]int, error) {
+	cm := d.opts.ChannelMap
+	if cm == ([4]int{}) {
+		cm = [4]int{0, 1, 2, 3}
+	} else if planes == 4 && cm[3] == 0 {
+		cm[3] = 3
+	}
+	var off [4]int
+	var seen [4]bool
+	for p := 0; p < planes; p++ {
+		c := cm[p]
+		if c < 0 || c >= planes || seen[c] {
+			return off, fmt.Errorf("pcx: invalid ChannelMap %v for %d planes", d.opts.ChannelMap, planes)
+		}
+		seen[c] = true
+		off[c] = p * stride
+	}
+	return off, nil
+}
+
+// colorPlanes returns the number of planes of a truecolor image that hold
+// color, which is fewer than it has if DecodeOptions.UsePlanes says so.
+func (d *decoder) colorPlanes() int {
+	if d.opts.UsePlanes > 0 {
+		return d.opts.UsePlanes
+	}
+	return d.nplanes
+}
+
+// decodeCMYK decodes 4-plane images whose planes are cyan, magenta, yellow
+// and key, the given number of bytes apart, into an *image.CMYK.
+func (d *decoder) decodeCMYK(stride int) (image.Image, error) {
+	bufR := d.br
+	width := d.bounds.Dx()
+	height := d.bounds.Dy()
+	d.newOutput(color.CMYKModel)
+	img := image.NewCMYK(d.pixBounds())
+	buf := make([]byte, d.bytesPerScanline)
+	for y := 0; y < height; y++ {
+		if err := d.readScanline(bufR, buf); err != nil {
+			return img, err
+		}
+		pix := img.Pix[d.pixRow(y)*img.Stride:]
+		for x := 0; x < width; x++ {
+			pix[4*x] = buf[x]
+			pix[4*x+1] = buf[x+stride]
+			pix[4*x+2] = buf[x+2*stride]
+			pix[4*x+3] = buf[x+3*stride]
+		}
+		d.storeRow(img, y)
+	}
+	return d.output(img), nil
 }
 
 func (d *decoder) decodeRGBPaletted() (image.Image, error) {
-	bufR := bufio.NewReader(d.r)
+	bufR := d.br
 
-	pal := make([]color.Color, 256)
-	img := image.NewPaletted(d.bounds, pal)
+	pal := d.palette
+	if pal == nil {
+		pal = make([]color.Color, 256)
+		if d.grayscale {
+			for i := range pal {
+				pal[i] = color.Gray{uint8(i)}
+			}
+		}
+	}
+	d.newOutput(color.Palette(pal))
+	img := image.NewPaletted(d.pixBounds(), pal)
+	width := d.bounds.Dx()
 	height := d.bounds.Dy()
+	buf := make([]byte, d.bytesPerScanline)
 	for y := 0; y < height; y++ {
-		if err := d.rleDecode(bufR, img.Pix[y*img.Stride:]); err != nil {
+		if err := d.readScanline(bufR, buf); err != nil {
 			return img, err
 		}
+		o := d.pixRow(y) * img.Stride
+		copy(img.Pix[o:o+width], buf)
+		if err := d.checkIndices(img.Pix[o:o+width], len(pal)); err != nil {
+			return img, err
+		}
+		d.storeRow(img, y)
 	}
 
-	// Read palette
-	palBytes := make([]byte, 3*256)
-	switch by, err := bufR.ReadByte(); {
-	case (err == nil && by != paletteMagic) || err == io.EOF:
-		return img, errors.New("pcx: missing extended palette")
-	case err != nil:
+	if err := d.finishPalette(bufR, pal); err != nil {
 		return img, err
 	}
-	if _, err := io.ReadFull(bufR, palBytes); err != nil {
-		return img, err
+	return d.output(img), nil
+}
+
+// finishPalette reads the extended palette into pal following the pixel data,
+// unless a preset palette is in use. A palette read ahead by seekPalette is
+// checked against the one that follows. The palette from
+// DecodeOptions.Palette is read past only to verify it or to reach the
+// trailer.
+func (d *decoder) finishPalette(bufR byteReader, pal []color.Color) error {
+	if d.seeked {
+		stored := make(color.Palette, 256)
+		if err := d.readExtendedPalette(bufR, stored); err != nil {
+			return err
+		}
+		for i := range stored {
+			if !sameRGBA(pal[i], stored[i]) {
+				d.palette = stored
+				return errPaletteMismatch
+			}
+		}
+		return nil
+	}
+	if d.palette == nil {
+		err := d.readExtendedPalette(bufR, pal)
+		if err == errMissingPalette && d.grayscale {
+			// Flagged as grayscale after all; keep the gray ramp.
+			return nil
+		}
+		return err
+	}
+	if d.opts.Palette == nil || !(d.opts.VerifyPalette || d.opts.Trailer || d.opts.Transparency) {
+		return nil
+	}
+	stored := make([]color.Color, 256)
+	if err := d.readExtendedPalette(bufR, stored); err != nil {
+		return err
+	}
+	if !d.opts.VerifyPalette {
+		return nil
+	}
+	for i, c := range d.opts.Palette {
+		if i >= len(stored) || !sameRGBA(c, stored[i]) {
+			return FormatError(fmt.Sprintf("extended palette entry %d differs from preset palette", i))
+		}
+	}
+	return nil
+}
+
+// sameRGBA reports whether a and b have the same premultiplied components.
+func sameRGBA(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+// errMissingPalette is returned when no extended palette follows the pixel
+// data of an 8bpp image.
+var errMissingPalette = errors.New("pcx: missing extended palette")
+
+// errPaletteMismatch is returned when the palette read ahead by seekPalette
+// is not the one following the pixel data, which is then in d.palette.
+var errPaletteMismatch = errors.New("pcx: palette at end of stream does not follow pixel data")
+
+// maxPaletteSkip is the number of stray bytes tolerated between the pixel data
+// and the extended palette magic unless decoding strictly.
+const maxPaletteSkip = 16
+
+// readExtendedPalette reads the 256 color VGA palette, including its leading
+// magic byte, that follows the pixel data of 8bpp images. Unless decoding
+// strictly, up to maxPaletteSkip stray bytes preceding the magic are ignored
+// and a palette cut short by the end of the file is padded with black. Even
+// when decoding strictly, a single zero byte that some tools insert to align
+// the palette to an even offset is skipped.
+func (d *decoder) readExtendedPalette(bufR byteReader, pal []color.Color) error {
+	for ; d.skipRows > 0; d.skipRows-- {
+		if err := d.decodeScanline(bufR, nil); err != nil {
+			return err
+		}
+	}
+	skip := maxPaletteSkip
+	if d.opts.Strict {
+		skip = 1
+	}
+	for i := 0; ; i++ {
+		by, err := bufR.ReadByte()
+		stray := by != paletteMagic && (i >= skip || d.opts.Strict && by != 0)
+		switch {
+		case err == io.EOF && d.limitReached():
+			return ErrReadLimit
+		case (err == nil && stray) || err == io.EOF:
+			return errMissingPalette
+		case err != nil:
+			return err
+		}
+		if by == paletteMagic {
+			d.repairs.PaletteOffset = i > 0
+			break
+		}
+	}
+	palBytes := make([]byte, 3*256)
+	if n, err := io.ReadFull(bufR, palBytes); err != nil {
+		if err == io.ErrUnexpectedEOF && d.limitReached() {
+			return ErrReadLimit
+		}
+		// Some tools only write as many entries as the image uses.
+		if err != io.ErrUnexpectedEOF || n%3 != 0 || d.opts.Strict {
+			return err
+		}
+		d.repairs.ShortPalette = true
 	}
 	for i := 0; i < 256; i++ {
-		pal[i] = color.RGBA{R: palBytes[i*3], G: palBytes[i*3+1], B: palBytes[i*3+2], A: 255}
+		pal[i] = d.paletteColor(palBytes[i*3:])
 	}
+	return nil
+}
 
-	return img, nil
+// paletteColor returns the palette entry stored in the first three bytes of
+// p, scaling them to 8 bits if requested.
+func (d *decoder) paletteColor(p []byte) color.Color {
+	c := color.RGBA{R: p[0], G: p[1], B: p[2], A: 255}
+	if d.opts.VGA6Bit {
+		c.R = scale6Bit(c.R)
+		c.G = scale6Bit(c.G)
+		c.B = scale6Bit(c.B)
+	}
+	return c
+}
+
+// scale6Bit maps a 6-bit VGA color component to 8 bits, clamping components
+// past the 6-bit range to full intensity.
+func scale6Bit(v byte) byte {
+	if v > 63 {
+		v = 63
+	}
+	return byte(uint(v) * 255 / 63)
 }
 
 func (d *decoder) decodePaletted() (image.Image, error) {
-	bufR := bufio.NewReader(d.r)
+	bufR := d.br
 
 	pal := make([]color.Color, 1<<uint(d.bpp))
 	switch {
-	case d.bpp == 1: // B&W
-		pal[0] = color.Black
-		pal[1] = color.White
+	case d.bpp == 1:
+		// Monochrome files may carry two colors, such as amber on black, in
+		// the colormap. An empty colormap, or the stock EGA palette many
+		// writers leave there, means black and white.
+		if cm := d.colormap[:6]; bytes.Equal(cm, []byte{0, 0, 0, 0, 0, 0}) || bytes.Equal(cm, []byte{0, 0, 0, 0, 0, 0xaa}) {
+			pal[0] = color.Black
+			pal[1] = color.White
+		} else {
+			pal[0] = d.paletteColor(d.colormap[0:])
+			pal[1] = d.paletteColor(d.colormap[3:])
+		}
 	case d.bpp == 2 && d.bounds.Dx() == 320 && d.bounds.Dy() == 200: // CGA
 		pal[0] = cga16ColorPalette[d.colormap[0]>>4]
 		idx := int(d.colormap[3] >> 5)
@@ -310,22 +1272,24 @@ func (d *decoder) decodePaletted() (image.Image, error) {
 		}
 		copy(pal[1:], cga4ColorPalettes[idx])
 	default: // EGA
-		for i := 0; i < len(pal)*3; i += 3 {
-			pal[i/3] = color.RGBA{R: d.colormap[i], G: d.colormap[i+1], B: d.colormap[i+2], A: 255}
+		for i := range pal {
+			pal[i] = d.paletteColor(d.colormap[i*3:])
 		}
 	}
 
-	img := image.NewPaletted(d.bounds, pal)
+	d.newOutput(color.Palette(pal))
+	img := image.NewPaletted(d.pixBounds(), pal)
 	width, height := d.bounds.Dx(), d.bounds.Dy()
 	buf := make([]byte, d.bytesPerScanline)
 	mask := byte((1 << uint(d.bpp)) - 1)
 	for y := 0; y < height; y++ {
-		if err := d.rleDecode(bufR, buf); err != nil {
+		if err := d.readScanline(bufR, buf); err != nil {
 			return img, err
 		}
+		row := img.Pix[d.pixRow(y)*img.Stride:]
 		shift := byte(8 - d.bpp)
 		for x, o := 0, 0; x < width; x++ {
-			img.Pix[y*img.Stride+x] = (buf[o] >> shift) & mask
+			row[x] = (buf[o] >> shift) & mask
 			if shift == 0 {
 				o++
 				shift = byte(8 - d.bpp)
@@ -333,47 +1297,297 @@ func (d *decoder) decodePaletted() (image.Image, error) {
 				shift -= byte(d.bpp)
 			}
 		}
+		if err := d.checkIndices(row[:width], len(pal)); err != nil {
+			return img, err
+		}
+		d.storeRow(img, y)
 	}
 
-	return img, nil
+	return d.output(img), nil
 }
 
 func (d *decoder) decodePlanar() (image.Image, error) {
-	pal := make([]color.Color, 1<<uint(d.nplanes))
-	for i := 0; i < len(pal)*3; i += 3 {
-		pal[i/3] = color.RGBA{R: d.colormap[i], G: d.colormap[i+1], B: d.colormap[i+2], A: 255}
+	// The header colormap holds the 16 colors of 4 planes; fewer planes use
+	// only its first entries.
+	n := 1 << uint(d.nplanes)
+	if max := len(d.colormap) / 3; n > max {
+		n = max
+	}
+	pal := make([]color.Color, n)
+	for i := range pal {
+		pal[i] = d.paletteColor(d.colormap[i*3:])
 	}
-	img := image.NewPaletted(d.bounds, pal)
+	d.newOutput(color.Palette(pal))
+	img := image.NewPaletted(d.pixBounds(), pal)
 
-	bufR := bufio.NewReader(d.r)
+	bufR := d.br
 	width := d.bounds.Dx()
 	height := d.bounds.Dy()
 	buf := make([]byte, d.bytesPerScanline)
 	for y := 0; y < height; y++ {
-		if err := d.rleDecode(bufR, buf); err != nil {
+		if err := d.readScanline(bufR, buf); err != nil {
 			return nil, err
 		}
+		row := img.Pix[d.pixRow(y)*img.Stride:]
 		for x := 0; x < width; x++ {
 			v := byte(0)
 			for i := 0; i < d.nplanes; i++ {
 				v = (v >> 1) | ((buf[d.bytesPerLine*i+(x/8)] << (uint(x) & 7)) & 0x80)
 			}
 			v >>= uint(8 - d.nplanes)
-			img.Pix[y*img.Stride+x] = v
+			row[x] = v
+		}
+		if err := d.checkIndices(row[:width], len(pal)); err != nil {
+			return nil, err
 		}
+		d.storeRow(img, y)
 	}
-	return img, nil
+	return d.output(img), nil
+}
+
+// decodePlanar2bpp decodes the nonstandard layout of four 2-bit planes, plane
+// 0 holding the least significant bits, that together index a 256 color
+// extended palette.
+func (d *decoder) decodePlanar2bpp() (image.Image, error) {
+	bufR := d.br
+
+	pal := d.palette
+	if pal == nil {
+		pal = make([]color.Color, 256)
+	}
+	d.newOutput(color.Palette(pal))
+	img := image.NewPaletted(d.pixBounds(), pal)
+	width := d.bounds.Dx()
+	height := d.bounds.Dy()
+	buf := make([]byte, d.bytesPerScanline)
+	for y := 0; y < height; y++ {
+		if err := d.readScanline(bufR, buf); err != nil {
+			return img, err
+		}
+		row := img.Pix[d.pixRow(y)*img.Stride:]
+		for x := 0; x < width; x++ {
+			shift := uint(6 - (x&3)*2)
+			v := byte(0)
+			for i := 0; i < 4; i++ {
+				v |= (buf[d.bytesPerLine*i+x/4] >> shift & 3) << uint(i*2)
+			}
+			row[x] = v
+		}
+		if err := d.checkIndices(row[:width], len(pal)); err != nil {
+			return img, err
+		}
+		d.storeRow(img, y)
+	}
+
+	if err := d.finishPalette(bufR, pal); err != nil {
+		return img, err
+	}
+	return d.output(img), nil
+}
+
+// colorIndexSetter is implemented by paletted images that store color
+// indices, such as *image.Paletted.
+type colorIndexSetter interface {
+	SetColorIndex(x, y int, index uint8)
+}
+
+// newOutput creates the image from DecodeOptions.NewImage, if set, with the
+// given color model. The decode loops then write each row to a single row
+// image that storeRow copies out.
+func (d *decoder) newOutput(model color.Model) {
+	if d.opts.NewImage == nil {
+		return
+	}
+	d.dst = d.opts.NewImage(d.bounds, model)
+	_, indexed := d.dst.(colorIndexSetter)
+	// Without color indices, the colors of 8bpp images are only known once
+	// the trailing palette has been read.
+	d.buffered = !indexed && d.hasExtendedPalette() && d.palette == nil
+}
+
+// pixBounds returns the bounds of the image the decode loops write to.
+func (d *decoder) pixBounds() image.Rectangle {
+	if d.dst == nil || d.buffered {
+		return d.bounds
+	}
+	return image.Rect(d.bounds.Min.X, d.bounds.Min.Y, d.bounds.Max.X, d.bounds.Min.Y+1)
+}
+
+// pixRow returns the row of the image from pixBounds to write scanline y to.
+func (d *decoder) pixRow(y int) int {
+	if d.dst == nil || d.buffered {
+		return d.row(y)
+	}
+	return 0
+}
+
+// storeRow copies scanline y from the single row image src to the image from
+// DecodeOptions.NewImage.
+func (d *decoder) storeRow(src image.Image, y int) {
+	if d.dst == nil || d.buffered {
+		return
+	}
+	d.copyRow(src, 0, d.row(y))
+}
+
+// copyRow copies row sy of src to row dy of the image from
+// DecodeOptions.NewImage, both relative to the top of their bounds.
+func (d *decoder) copyRow(src image.Image, sy, dy int) {
+	sy += src.Bounds().Min.Y
+	dy += d.bounds.Min.Y
+	if p, ok := src.(*image.Paletted); ok {
+		if dst, ok := d.dst.(colorIndexSetter); ok {
+			for x := d.bounds.Min.X; x < d.bounds.Max.X; x++ {
+				dst.SetColorIndex(x, dy, p.ColorIndexAt(x, sy))
+			}
+			return
+		}
+	}
+	for x := d.bounds.Min.X; x < d.bounds.Max.X; x++ {
+		d.dst.Set(x, dy, src.At(x, sy))
+	}
+}
+
+// output returns the decoded image, img itself unless decoding into an image
+// from DecodeOptions.NewImage.
+func (d *decoder) output(img image.Image) image.Image {
+	if d.dst == nil {
+		return img
+	}
+	if d.buffered {
+		for y := 0; y < d.bounds.Dy(); y++ {
+			d.copyRow(img, y, y)
+		}
+	}
+	return d.dst
+}
+
+// checkIndices ensures that the color indices in row are within a palette of
+// n colors. Indices past the end are an error when decoding strictly and are
+// otherwise clamped to the last color.
+func (d *decoder) checkIndices(row []uint8, n int) error {
+	if bits := d.bpp * d.nplanes; n >= 256 || (bits < 8 && n >= 1<<uint(bits)) {
+		return nil
+	}
+	for i, v := range row {
+		if int(v) < n {
+			continue
+		}
+		if d.opts.Strict || n == 0 {
+			return FormatError(fmt.Sprintf("color index %d out of palette range", v))
+		}
+		row[i] = uint8(n - 1)
+	}
+	return nil
+}
+
+// row returns the destination row in the image for scanline y.
+func (d *decoder) row(y int) int {
+	if d.opts.FlipVertical {
+		return d.bounds.Dy() - 1 - y
+	}
+	return y
+}
+
+// readScanline decodes the next scanline of all planes into out and records
+// any per-scanline metadata requested by the options.
+func (d *decoder) readScanline(bufR byteReader, out []byte) error {
+	if d.ctx != nil {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if err := d.decodeScanline(bufR, out); err != nil {
+		return err
+	}
+	if d.opts.Checksums {
+		d.meta.Checksums = append(d.meta.Checksums, crc32.ChecksumIEEE(out[:d.bytesPerScanline]))
+	}
+	return nil
+}
+
+// decodeScanline reads the next scanline into out, which may be shorter than
+// bytesPerScanline (or nil) to discard the excess.
+func (d *decoder) decodeScanline(bufR byteReader, out []byte) error {
+	if d.opts.ScanlineLengthPrefix {
+		return d.decodePrefixedScanline(bufR, out)
+	}
+	if d.rle {
+		return d.rleDecode(bufR, out)
+	}
+	return d.rawDecode(bufR, out)
+}
+
+// decodePrefixedScanline reads a scanline preceded by its encoded length as
+// a 16-bit little-endian count. Bytes beyond those the scanline needs are
+// skipped, so a malformed scanline does not corrupt those following it.
+func (d *decoder) decodePrefixedScanline(bufR byteReader, out []byte) error {
+	var n [2]byte
+	if _, err := io.ReadFull(bufR, n[:]); err != nil {
+		return err
+	}
+	length := int(n[0]) | int(n[1])<<8
+	if cap(d.prefixed) < length {
+		d.prefixed = make([]byte, length)
+	}
+	d.prefixed = d.prefixed[:length]
+	if _, err := io.ReadFull(bufR, d.prefixed); err != nil {
+		return err
+	}
+	d.prefixedR.Reset(d.prefixed)
+	var err error
+	if d.rle {
+		err = d.rleDecode(&d.prefixedR, out)
+	} else {
+		err = d.rawDecode(&d.prefixedR, out)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError("scanline longer than its length prefix")
+	}
+	return err
+}
+
+func (d *decoder) rawDecode(bufR byteReader, out []byte) error {
+	n := d.bytesPerScanline
+	if len(out) < n {
+		n = len(out)
+	}
+	if _, err := io.ReadFull(bufR, out[:n]); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, bufR, int64(d.bytesPerScanline-n))
+	return err
+}
+
+// rleThreshold returns the smallest byte starting a run given the configured
+// threshold, which is 0xc0 if unset.
+func rleThreshold(t byte) byte {
+	if t == 0 {
+		return 0xc0
+	}
+	return t
+}
+
+// validRLEThreshold reports whether t, if set, has at least its top bit and
+// at most its top four bits set, leaving room for a useful run length.
+func validRLEThreshold(t byte) bool {
+	switch t {
+	case 0, 0x80, 0xc0, 0xe0, 0xf0:
+		return true
+	}
+	return false
 }
 
-func (d *decoder) rleDecode(bufR *bufio.Reader, out []byte) error {
+func (d *decoder) rleDecode(bufR byteReader, out []byte) error {
+	threshold := rleThreshold(d.opts.RLEThreshold)
 	for off := 0; off < d.bytesPerScanline; {
 		val, err := bufR.ReadByte()
 		if err != nil {
 			return err
 		}
 		run := 1
-		if val >= 0xc0 {
-			run = int(val & 0x3f)
+		if val >= threshold {
+			run = int(val &^ threshold)
 			val, err = bufR.ReadByte()
 			if err != nil {
 				return err
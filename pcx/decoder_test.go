@@ -1,8 +1,17 @@
 package pcx
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
 	"image/png"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -48,3 +57,1569 @@ func TestDecoder(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeChecksums(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 5, 3), color.Palette{color.Black, color.White})
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i & 1)
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := DecodeWithOptions(buf, &DecodeOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Checksums) != 3 {
+		t.Fatalf("expected 3 checksums, got %d", len(meta.Checksums))
+	}
+	for y, sum := range meta.Checksums {
+		line := append(append([]byte{}, m.Pix[y*m.Stride:y*m.Stride+5]...), 0)
+		if want := crc32.ChecksumIEEE(line); sum != want {
+			t.Errorf("scanline %d: checksum %08x, want %08x", y, sum, want)
+		}
+	}
+}
+
+// makeHeader returns a 128-byte RLE PCX header for tests.
+func makeHeader(version, bpp, nplanes, bytesPerLine int, b image.Rectangle) []byte {
+	hdr := make([]byte, 128)
+	hdr[0] = magic
+	hdr[1] = byte(version)
+	hdr[2] = 1
+	hdr[3] = byte(bpp)
+	binary.LittleEndian.PutUint16(hdr[4:], uint16(b.Min.X))
+	binary.LittleEndian.PutUint16(hdr[6:], uint16(b.Min.Y))
+	binary.LittleEndian.PutUint16(hdr[8:], uint16(b.Max.X-1))
+	binary.LittleEndian.PutUint16(hdr[10:], uint16(b.Max.Y-1))
+	hdr[65] = byte(nplanes)
+	binary.LittleEndian.PutUint16(hdr[66:], uint16(bytesPerLine))
+	hdr[68] = 1
+	return hdr
+}
+
+// rleLines RLE-encodes each scanline separately and concatenates the result.
+func rleLines(lines ...[]byte) []byte {
+	var out []byte
+	r := &rleBuffer{}
+	for _, l := range lines {
+		r.reset()
+		for _, b := range l {
+			r.put(b)
+		}
+		out = append(out, r.flush()...)
+	}
+	return out
+}
+
+func TestDecodeVersion5EGAHeaderPalette(t *testing.T) {
+	hdr := makeHeader(5, 4, 1, 3, image.Rect(0, 0, 5, 2))
+	for i := 0; i < 16; i++ {
+		hdr[16+i*3] = byte(i * 16)
+		hdr[17+i*3] = byte(i)
+		hdr[18+i*3] = 0xff - byte(i)
+	}
+	data := append(hdr, rleLines(
+		[]byte{0x01, 0x23, 0x40},
+		[]byte{0xfe, 0xdc, 0xb0},
+	)...)
+
+	want := [][]uint8{{0, 1, 2, 3, 4}, {15, 14, 13, 12, 11}}
+	// A trailing VGA palette must be ignored rather than required.
+	for _, trailer := range [][]byte{nil, append([]byte{paletteMagic}, make([]byte, 768)...)} {
+		img, err := Decode(bytes.NewReader(append(append([]byte{}, data...), trailer...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, ok := img.(*image.Paletted)
+		if !ok {
+			t.Fatalf("expected *image.Paletted, got %T", img)
+		}
+		if len(p.Palette) != 16 {
+			t.Fatalf("expected 16 color palette, got %d", len(p.Palette))
+		}
+		if c := p.Palette[3]; c != (color.RGBA{0x30, 0x03, 0xfc, 0xff}) {
+			t.Errorf("palette[3] = %v", c)
+		}
+		for y, row := range want {
+			for x, idx := range row {
+				if got := p.ColorIndexAt(x, y); got != idx {
+					t.Errorf("index at (%d,%d) = %d, want %d", x, y, got, idx)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeFlipVertical(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			m.Set(x, y, color.RGBA{uint8(y * 10), uint8(x), 0, 0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := DecodeWithOptions(buf, &DecodeOptions{FlipVertical: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			if got, want := img.At(x, y), m.At(x, 2-y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestReadPalette(t *testing.T) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i), 0x20, uint8(255 - i), 0xff}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 5, 5), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 11)
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []io.Reader{
+		bytes.NewReader(buf.Bytes()),
+		struct{ io.Reader }{bytes.NewReader(buf.Bytes())},
+	} {
+		got, err := ReadPalette(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range pal {
+			if got[i] != pal[i] {
+				t.Fatalf("%T: palette[%d] = %v, want %v", r, i, got[i], pal[i])
+			}
+		}
+	}
+
+	// Seekable readers skip the pixel data, here cut short.
+	data := buf.Bytes()
+	data = append(data[:130:130], data[len(data)-(1+3*256):]...)
+	got, err := ReadPalette(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[200] != pal[200] {
+		t.Errorf("seeking: palette[200] = %v, want %v", got[200], pal[200])
+	}
+	if _, err := ReadPalette(struct{ io.Reader }{bytes.NewReader(data)}); err == nil {
+		t.Error("expected error reading through truncated pixel data")
+	}
+}
+
+func TestDecodePaletteMagicAfterGarbage(t *testing.T) {
+	hdr := makeHeader(5, 8, 1, 3, image.Rect(0, 0, 3, 1))
+	data := append(hdr, rleLines([]byte{1, 2, 3})...)
+	data = append(data, 0, 0, 0)
+	data = append(data, paletteMagic)
+	data = append(data, make([]byte, 768)...)
+	data[len(data)-768+3*2] = 0xaa
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.(*image.Paletted).Palette[2]; c != (color.RGBA{0xaa, 0, 0, 0xff}) {
+		t.Errorf("palette[2] = %v", c)
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true}); err == nil {
+		t.Error("expected strict decode to fail")
+	}
+}
+
+func TestMetadataSourceColors(t *testing.T) {
+	for _, tc := range []struct {
+		bpp, nplanes, bytesPerLine int
+		colors                     int
+	}{
+		{1, 1, 2, 2},
+		{2, 1, 2, 4},
+		{4, 1, 2, 16},
+		{1, 4, 2, 16},
+		{8, 1, 4, 256},
+		{8, 3, 4, -1},
+	} {
+		hdr := makeHeader(5, tc.bpp, tc.nplanes, tc.bytesPerLine, image.Rect(0, 0, 3, 1))
+		data := append(hdr, rleLines(make([]byte, tc.bytesPerLine*tc.nplanes))...)
+		data = append(data, paletteMagic)
+		data = append(data, make([]byte, 768)...)
+		_, meta, err := DecodeWithOptions(bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := meta.SourceColors(); got != tc.colors {
+			t.Errorf("%d bpp %d planes: SourceColors() = %d, want %d", tc.bpp, tc.nplanes, got, tc.colors)
+		}
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := EncodeSolid(buf, color.White, 9, 9); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := DecodeContext(context.Background(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DecodeContext(ctx, bytes.NewReader(data)); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMetadataHeader(t *testing.T) {
+	hdr := makeHeader(5, 8, 3, 3, image.Rect(0, 0, 3, 1))
+	binary.LittleEndian.PutUint16(hdr[12:], 300)
+	binary.LittleEndian.PutUint16(hdr[14:], 150)
+	hdr[64] = 0x17
+	hdr[68] = 1
+	hdr[69] = 0x80
+	hdr[74] = 'P'
+	hdr[127] = 0x42
+	data := append(hdr, rleLines(make([]byte, 9))...)
+	_, meta, err := DecodeWithOptions(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := meta.Header
+	if h.Version != 5 || !h.RLE || h.BitsPerPixel != 8 || h.Planes != 3 || h.BytesPerLine != 3 {
+		t.Errorf("unexpected header %+v", h)
+	}
+	if h.HorizDPI != 300 || h.VertDPI != 150 || h.PaletteInfo != 0x8001 {
+		t.Errorf("unexpected header %+v", h)
+	}
+	if h.Filler[0] != 'P' || h.Filler[53] != 0x42 {
+		t.Errorf("unexpected filler %x", h.Filler)
+	}
+	if h.Reserved != [2]byte{0x17, 0x80} {
+		t.Errorf("unexpected reserved bytes %x", h.Reserved)
+	}
+}
+
+func TestDecodeAt(t *testing.T) {
+	buf := bytes.NewBufferString("archive header")
+	if err := EncodeSolid(buf, color.White, 3, 5); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("next entry")
+	img, err := DecodeAt(bytes.NewReader(buf.Bytes()), int64(len("archive header")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 3 || b.Dy() != 5 {
+		t.Errorf("bounds %v", b)
+	}
+}
+
+func TestDecodeMaxBytesRead(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 33, 33))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	n := int64(len(data) - 128)
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: n}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: n - 1}); err != ErrReadLimit {
+		t.Errorf("expected ErrReadLimit, got %v", err)
+	}
+}
+
+func TestDecodeMaxBytesReadPalette(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 9)
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	end := int64(buf.Len() - 128)
+	pixels := end - (1 + 3*256)
+	buf.Reset()
+	if err := EncodeWithOptions(buf, m, &EncodeOptions{Properties: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: end}); err != nil {
+		t.Fatal(err)
+	}
+	// Cut at the palette magic, inside the palette and just before its end.
+	for _, n := range []int64{pixels, pixels + 1 + 3, pixels + 1 + 300, end - 1} {
+		if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: n}); err != ErrReadLimit {
+			t.Errorf("limit %d: got %v, want ErrReadLimit", n, err)
+		}
+	}
+	// The trailer is cut short by a limit at the end of the palette.
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: end, Trailer: true}); err != ErrReadLimit {
+		t.Errorf("trailer past limit: got %v, want ErrReadLimit", err)
+	}
+	if _, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{MaxBytesRead: int64(len(data)), Trailer: true}); err != nil {
+		t.Fatal(err)
+	} else if meta.Properties["k"] != "v" {
+		t.Errorf("properties = %v", meta.Properties)
+	}
+}
+
+// readCounter counts the reads made of the reader it wraps, and hides any
+// methods other than Read so that the decoder must buffer it.
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestDecodeReadBufferSize(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+		if i%4 == 3 {
+			m.Pix[i] = 0xff
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	reads := make(map[int]int)
+	for _, size := range []int{0, 64, 1 << 16} {
+		rc := &readCounter{r: bytes.NewReader(data)}
+		img, _, err := DecodeWithOptions(rc, &DecodeOptions{ReadBufferSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameColor(img.At(63, 63), m.At(63, 63)) {
+			t.Errorf("size %d: decoded pixel differs", size)
+		}
+		reads[size] = rc.reads
+	}
+	if !(reads[64] > reads[0] && reads[0] > reads[1<<16]) {
+		t.Errorf("reads by buffer size = %v, want fewer reads for larger buffers", reads)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	valid := makeHeader(5, 8, 3, 4, image.Rect(0, 0, 3, 2))
+	if !Sniff(valid) {
+		t.Error("valid header not detected")
+	}
+	for name, mod := range map[string]func(h []byte){
+		"short":          func(h []byte) {},
+		"magic":          func(h []byte) { h[0] = 0 },
+		"version":        func(h []byte) { h[1] = 9 },
+		"encoding":       func(h []byte) { h[2] = 7 },
+		"bpp":            func(h []byte) { h[3] = 12 },
+		"planes":         func(h []byte) { h[65] = 0 },
+		"window":         func(h []byte) { h[4] = 10 },
+		"bytes per line": func(h []byte) { h[66] = 0 },
+	} {
+		h := append([]byte{}, valid...)
+		mod(h)
+		if name == "short" {
+			h = h[:64]
+		}
+		if Sniff(h) {
+			t.Errorf("%s: invalid header detected as PCX", name)
+		}
+	}
+}
+
+func TestDecodePlanarShortBytesPerLine(t *testing.T) {
+	// 9 pixels need 2 bytes per plane.
+	hdr := makeHeader(5, 1, 4, 1, image.Rect(0, 0, 9, 1))
+	data := append(hdr, rleLines(make([]byte, 4))...)
+	_, err := Decode(bytes.NewReader(data))
+	if _, ok := err.(FormatError); !ok {
+		t.Errorf("expected FormatError, got %v", err)
+	}
+}
+
+func benchmarkDecode(b *testing.B, encode func(w io.Writer) error) {
+	buf := &bytes.Buffer{}
+	if err := encode(buf); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeRGB(b *testing.B) {
+	m := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 7)
+	}
+	benchmarkDecode(b, func(w io.Writer) error { return Encode(w, m) })
+}
+
+func BenchmarkDecodePaletted(b *testing.B) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i)}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 256, 256), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 5)
+	}
+	benchmarkDecode(b, func(w io.Writer) error { return Encode(w, m) })
+}
+
+func BenchmarkDecodePlanar(b *testing.B) {
+	pal := make(color.Palette, 16)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i * 16)}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 256, 256), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i/3) & 15
+	}
+	benchmarkDecode(b, func(w io.Writer) error { return EncodeLegacy(w, m) })
+}
+
+func TestDecodeShortExtendedPalette(t *testing.T) {
+	hdr := makeHeader(5, 8, 1, 3, image.Rect(0, 0, 3, 1))
+	data := append(hdr, rleLines([]byte{0, 15, 1})...)
+	data = append(data, paletteMagic)
+	for i := 0; i < 16; i++ {
+		data = append(data, uint8(i), uint8(i*2), uint8(i*3))
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pal := img.(*image.Paletted).Palette
+	if c := pal[15]; c != (color.RGBA{15, 30, 45, 0xff}) {
+		t.Errorf("palette[15] = %v", c)
+	}
+	if c := pal[16]; c != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("palette[16] = %v, want black", c)
+	}
+	if p, err := ReadPalette(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	} else if p[15] != pal[15] {
+		t.Errorf("ReadPalette palette[15] = %v", p[15])
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true}); err == nil {
+		t.Error("expected strict decode to fail")
+	}
+}
+
+func TestDecodeZeroPlanes(t *testing.T) {
+	hdr := makeHeader(5, 8, 0, 4, image.Rect(0, 0, 3, 1))
+	data := append(hdr, rleLines(make([]byte, 4))...)
+	want := FormatError("invalid plane count (0)")
+	if _, err := DecodeConfig(bytes.NewReader(data)); err != want {
+		t.Errorf("DecodeConfig error = %v, want %v", err, want)
+	}
+	if _, err := Decode(bytes.NewReader(data)); err != want {
+		t.Errorf("Decode error = %v, want %v", err, want)
+	}
+}
+
+// TestDecodeMaxLowByte checks that the inclusive maximum is assembled from
+// both bytes before adding one, for values whose low byte is not zero.
+func TestDecodeMaxLowByte(t *testing.T) {
+	for _, last := range []image.Point{{0x0101, 0x0102}, {0x01ff, 0x02ff}} {
+		want := image.Pt(last.X+1, last.Y+1)
+		hdr := makeHeader(5, 8, 1, want.X+want.X&1, image.Rectangle{Max: want})
+		cfg, err := DecodeConfig(bytes.NewReader(hdr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := image.Pt(cfg.Width, cfg.Height); got != want {
+			t.Errorf("last %#x: size %v, want %v", last, got, want)
+		}
+	}
+}
+
+func TestDecodeWindowPlacement(t *testing.T) {
+	for _, b := range []image.Rectangle{
+		image.Rect(10, 20, 15, 23),
+		image.Rect(-4, -2, 3, 5),
+	} {
+		m := image.NewRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				m.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		img, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != b {
+			t.Fatalf("decoded bounds %v, want %v", img.Bounds(), b)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if got, want := img.At(x, y), m.At(x, y); got != want {
+					t.Fatalf("%v: pixel (%d,%d) = %v, want %v", b, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeInvalidPlaneCount(t *testing.T) {
+	for _, nplanes := range []int{9, 255} {
+		hdr := makeHeader(5, 1, nplanes, 2, image.Rect(0, 0, 3, 1))
+		_, err := Decode(bytes.NewReader(hdr))
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("%d planes: expected FormatError, got %v", nplanes, err)
+		}
+	}
+}
+
+// countingImage records how many pixels are stored through Set.
+type countingImage struct {
+	draw.Image
+	sets int
+}
+
+func (c *countingImage) Set(x, y int, col color.Color) {
+	c.sets++
+	c.Image.Set(x, y, col)
+}
+
+func TestDecodeNewImage(t *testing.T) {
+	b := image.Rect(2, 3, 7, 6)
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i), uint8(i * 3), 0x40, 0xff}
+	}
+	paletted := image.NewPaletted(b, pal)
+	rgba := image.NewRGBA(b)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 9)
+	}
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 5)
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xff
+		}
+	}
+
+	for _, m := range []image.Image{paletted, rgba} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		for _, flip := range []bool{false, true} {
+			var created *countingImage
+			opts := &DecodeOptions{
+				FlipVertical: flip,
+				NewImage: func(bounds image.Rectangle, model color.Model) draw.Image {
+					created = &countingImage{Image: image.NewNRGBA(bounds)}
+					return created
+				},
+			}
+			img, _, err := DecodeWithOptions(bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img != created {
+				t.Fatalf("%T: decoded into %T, not the created image", m, img)
+			}
+			if created.sets != b.Dx()*b.Dy() {
+				t.Errorf("%T: %d pixels set, want %d", m, created.sets, b.Dx()*b.Dy())
+			}
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				sy := y
+				if flip {
+					sy = b.Max.Y - 1 - (y - b.Min.Y)
+				}
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if !sameColor(img.At(x, y), m.At(x, sy)) {
+						t.Fatalf("%T flip=%v: pixel (%d,%d) = %v, want %v", m, flip, x, y, img.At(x, y), m.At(x, sy))
+					}
+				}
+			}
+		}
+	}
+
+	// Paletted images that store indices receive them directly.
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, paletted); err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := DecodeWithOptions(buf, &DecodeOptions{
+		NewImage: func(bounds image.Rectangle, model color.Model) draw.Image {
+			return image.NewPaletted(bounds, model.(color.Palette))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.(*image.Paletted).Pix, paletted.Pix) {
+		t.Error("color indices differ")
+	}
+}
+
+func TestDecodePlanar2bpp(t *testing.T) {
+	indices := [][]uint8{
+		{0x00, 0x1b, 0xe4, 0xff, 0x42},
+		{0x81, 0x7e, 0x3c, 0xc3, 0x99},
+	}
+	hdr := makeHeader(5, 2, 4, 2, image.Rect(0, 0, 5, 2))
+	var data []byte
+	data = append(data, hdr...)
+	for _, row := range indices {
+		line := make([]byte, 8)
+		for x, v := range row {
+			for i := 0; i < 4; i++ {
+				line[2*i+x/4] |= (v >> uint(i*2) & 3) << uint(6-(x&3)*2)
+			}
+		}
+		data = append(data, rleLines(line)...)
+	}
+	data = append(data, paletteMagic)
+	for i := 0; i < 256; i++ {
+		data = append(data, uint8(i), 0, uint8(255-i))
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := img.(*image.Paletted)
+	for y, row := range indices {
+		for x, v := range row {
+			if got := p.ColorIndexAt(x, y); got != v {
+				t.Errorf("index at (%d,%d) = %#x, want %#x", x, y, got, v)
+			}
+		}
+	}
+	if c := p.Palette[0x42]; c != (color.RGBA{0x42, 0, 0xbd, 0xff}) {
+		t.Errorf("palette[0x42] = %v", c)
+	}
+}
+
+func TestDecodePlaneStride(t *testing.T) {
+	// Planes of 3 pixels packed back to back in 4 bytes per line.
+	hdr := makeHeader(5, 8, 3, 4, image.Rect(0, 0, 3, 1))
+	data := append(hdr, rleLines([]byte{10, 11, 12, 20, 21, 22, 30, 31, 32, 0, 0, 0})...)
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{PlaneStride: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 3; x++ {
+		want := color.RGBA{uint8(10 + x), uint8(20 + x), uint8(30 + x), 0xff}
+		if c := img.At(x, 0); c != want {
+			t.Errorf("pixel %d = %v, want %v", x, c, want)
+		}
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{PlaneStride: 5}); err == nil {
+		t.Error("expected error for stride past the scanline")
+	}
+}
+
+func TestDecodeRGBCroppedWindow(t *testing.T) {
+	// A 2x2 window cropped from a canvas 6 bytes wide: planes are bytesPerLine
+	// apart, and the bytes past the window in each plane must be ignored.
+	hdr := makeHeader(5, 8, 3, 6, image.Rect(2, 3, 4, 5))
+	var lines [][]byte
+	for y := 0; y < 2; y++ {
+		var l []byte
+		for p := 0; p < 3; p++ {
+			b := byte(0x10*(p+1) + 2*y)
+			l = append(l, b, b+1, 0xee, 0xee, 0xee, 0xee)
+		}
+		lines = append(lines, l)
+	}
+	img, err := Decode(bytes.NewReader(append(hdr, rleLines(lines...)...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b != image.Rect(2, 3, 4, 5) {
+		t.Fatalf("bounds = %v", b)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			v := uint8(2*y + x)
+			want := color.RGBA{0x10 + v, 0x20 + v, 0x30 + v, 0xff}
+			if c := img.At(2+x, 3+y); c != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+func TestDecodeVGA6Bit(t *testing.T) {
+	// 8bpp image using palette entry 1.
+	hdr := makeHeader(5, 8, 1, 2, image.Rect(0, 0, 1, 1))
+	vga := append(hdr, rleLines([]byte{1, 0})...)
+	vga = append(vga, paletteMagic)
+	pal := make([]byte, 3*256)
+	// Components past the 6-bit range clamp to full intensity.
+	copy(pal[3:], []byte{0x40, 32, 0})
+	vga = append(vga, pal...)
+
+	// 4-plane EGA image using colormap entry 1.
+	ega := makeHeader(5, 1, 4, 2, image.Rect(0, 0, 1, 1))
+	copy(ega[16+3:], []byte{63, 32, 0})
+	ega = append(ega, rleLines([]byte{0x80, 0, 0, 0, 0, 0, 0, 0})...)
+
+	for _, data := range [][]byte{vga, ega} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{VGA6Bit: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, want := img.At(0, 0), (color.RGBA{255, 129, 0, 255}); c != want {
+			t.Errorf("%d planes: got %v, want %v", data[65], c, want)
+		}
+	}
+}
+
+func TestDecodeConfigUncompressed(t *testing.T) {
+	hdr := makeHeader(5, 8, 3, 4, image.Rect(0, 0, 3, 2))
+	hdr[2] = 0
+	data := append(hdr, make([]byte, 2*3*4)...)
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 3 || cfg.Height != 2 {
+		t.Errorf("got %dx%d, want 3x2", cfg.Width, cfg.Height)
+	}
+	_, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || name != "pcx" {
+		t.Errorf("image.DecodeConfig = %q, %v", name, err)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("image.Decode: %v", err)
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	rgba.Set(1, 1, color.RGBA{1, 2, 3, 0xff})
+	paletted := image.NewPaletted(image.Rect(0, 0, 5, 4), color.Palette{color.Black, color.White})
+	paletted.SetColorIndex(4, 3, 1)
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.Pix[0] = 0x80
+	want := []image.Image{rgba, paletted, gray}
+
+	var buf bytes.Buffer
+	for _, m := range want {
+		if err := EncodeWithOptions(&buf, m, &EncodeOptions{Compression: CompressionNone}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+	// An io.Reader without ReadByte must not be read ahead of each image.
+	imgs, err := DecodeStream(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2*len(want) {
+		t.Fatalf("decoded %d images, want %d", len(imgs), 2*len(want))
+	}
+	for i, m := range imgs {
+		w := want[i/2]
+		if m.Bounds() != w.Bounds() {
+			t.Fatalf("image %d: bounds %v, want %v", i, m.Bounds(), w.Bounds())
+		}
+		b := w.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !sameColor(m.At(x, y), w.At(x, y)) {
+					t.Errorf("image %d: pixel (%d, %d) = %v, want %v", i, x, y, m.At(x, y), w.At(x, y))
+				}
+			}
+		}
+	}
+
+	if _, err := DecodeStream(bytes.NewReader(append(data, 0))); err == nil {
+		t.Error("expected error for trailing garbage")
+	}
+
+	// Pixel data starting with a literal of index 12, the palette magic,
+	// must not be read past.
+	m := image.NewPaletted(image.Rect(0, 0, 4, 2), palette.Plan9)
+	m.Pix[0] = paletteMagic
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		if err := EncodeWithOptions(&buf, m, &EncodeOptions{Compression: CompressionNone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imgs, err = DecodeStream(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 3 {
+		t.Fatalf("decoded %d images starting with the palette magic, want 3", len(imgs))
+	}
+	for i, img := range imgs {
+		if p, ok := img.(*image.Paletted); !ok || !bytes.Equal(p.Pix, m.Pix) {
+			t.Errorf("image %d starting with the palette magic differs", i)
+		}
+	}
+}
+
+func TestDecodeRLEThreshold(t *testing.T) {
+	// 0x85 is a run of 5 with threshold 0x80, 0x90 a run of 16, and 0x7f a
+	// literal.
+	hdr := makeHeader(5, 8, 1, 22, image.Rect(0, 0, 22, 1))
+	data := append(hdr, 0x85, 3, 0x90, 0xc0, 0x7f)
+	data = append(data, paletteMagic)
+	data = append(data, make([]byte, 3*256)...)
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{RLEThreshold: 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := img.(*image.Paletted)
+	want := append(append(bytes.Repeat([]byte{3}, 5), bytes.Repeat([]byte{0xc0}, 16)...), 0x7f)
+	if !bytes.Equal(p.Pix, want) {
+		t.Errorf("decoded %x, want %x", p.Pix, want)
+	}
+
+	m := image.NewPaletted(image.Rect(0, 0, 200, 1), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(0xa0 + i/100)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, m, &EncodeOptions{RLEThreshold: 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	// Runs of 100 fit in a single run with 7 bits for the length.
+	if got := buf.Bytes()[128:132]; !bytes.Equal(got, []byte{0xe4, 0xa0, 0xe4, 0xa1}) {
+		t.Errorf("encoded %x", got)
+	}
+	img, _, err = DecodeWithOptions(&buf, &DecodeOptions{RLEThreshold: 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.(*image.Paletted).Pix, m.Pix) {
+		t.Error("round trip mismatch")
+	}
+
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{RLEThreshold: 0x40}); err == nil {
+		t.Error("expected error for invalid threshold")
+	}
+}
+
+func TestDecodePaletteIndexRange(t *testing.T) {
+	hdr := makeHeader(5, 8, 1, 4, image.Rect(0, 0, 4, 1))
+	data := append(hdr, rleLines([]byte{0, 1, 2, 200})...)
+	pal := color.Palette{color.Black, color.White}
+
+	for _, strict := range []bool{false, true} {
+		d, err := newDecoder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.palette = pal
+		d.opts.Strict = strict
+		img, err := d.decode()
+		if strict {
+			if _, ok := err.(FormatError); !ok {
+				t.Errorf("strict: got error %v, want FormatError", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.(*image.Paletted).Pix; !bytes.Equal(got, []byte{0, 1, 1, 1}) {
+			t.Errorf("clamped indices %v, want [0 1 1 1]", got)
+		}
+	}
+}
+
+func TestDecodeMonochromeColormap(t *testing.T) {
+	hdr := makeHeader(5, 1, 1, 2, image.Rect(0, 0, 2, 1))
+	data := append(hdr, rleLines([]byte{0x40, 0})...)
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(img.At(0, 0), color.Black) || !sameColor(img.At(1, 0), color.White) {
+		t.Errorf("empty colormap decoded as %v, %v", img.At(0, 0), img.At(1, 0))
+	}
+
+	amber := color.RGBA{0xff, 0xb0, 0, 0xff}
+	copy(hdr[16:], []byte{0, 0, 0, amber.R, amber.G, amber.B})
+	data = append(hdr, rleLines([]byte{0x40, 0})...)
+	img, err = Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.At(0, 0) != (color.RGBA{0, 0, 0, 0xff}) || img.At(1, 0) != amber {
+		t.Errorf("amber colormap decoded as %v, %v", img.At(0, 0), img.At(1, 0))
+	}
+
+	// Writers often leave the stock EGA palette in the colormap.
+	for i, c := range cga16ColorPalette {
+		r, g, b, _ := c.RGBA()
+		copy(hdr[16+i*3:], []byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)})
+	}
+	data = append(hdr, rleLines([]byte{0x40, 0})...)
+	img, err = Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(img.At(0, 0), color.Black) || !sameColor(img.At(1, 0), color.White) {
+		t.Errorf("EGA colormap decoded as %v, %v", img.At(0, 0), img.At(1, 0))
+	}
+}
+
+func TestDecodeGray(t *testing.T) {
+	b := image.Rect(0, 0, 3, 1)
+	colors := []color.Color{color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0x80, 0xff, 0xff}, color.White}
+	rgba := image.NewRGBA(b)
+	paletted := image.NewPaletted(b, colors)
+	gray := image.NewGray(b)
+	for x, c := range colors {
+		rgba.Set(x, 0, c)
+		paletted.SetColorIndex(x, 0, uint8(x))
+		gray.Set(x, 0, c)
+	}
+	for _, m := range []image.Image{rgba, paletted, gray} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeGray(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Pix, gray.Pix) {
+			t.Errorf("%T: decoded %v, want %v", m, got.Pix, gray.Pix)
+		}
+	}
+}
+
+func TestDecodeCGA(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags byte // top bits of colormap byte 3
+		want  [3]color.Color
+	}{
+		{"palette 0 dim", 0x00, [3]color.Color{cga16ColorPalette[2], cga16ColorPalette[4], cga16ColorPalette[6]}},
+		{"palette 0 bright", 0x20, [3]color.Color{cga16ColorPalette[10], cga16ColorPalette[12], cga16ColorPalette[14]}},
+		{"palette 1 dim", 0x40, [3]color.Color{cga16ColorPalette[3], cga16ColorPalette[5], cga16ColorPalette[7]}},
+		{"palette 1 bright", 0x60, [3]color.Color{cga16ColorPalette[11], cga16ColorPalette[13], cga16ColorPalette[15]}},
+	} {
+		hdr := makeHeader(3, 2, 1, 80, image.Rect(0, 0, 320, 200))
+		hdr[68] = 0 // written before PC Paintbrush 4.0
+		hdr[16] = 1 << 4
+		hdr[19] = tc.flags
+		line := make([]byte, 80)
+		line[0] = 0x1b // pixels 0, 1, 2, 3
+		lines := make([][]byte, 200)
+		for i := range lines {
+			lines[i] = line
+		}
+		img, err := Decode(bytes.NewReader(append(hdr, rleLines(lines...)...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := img.At(0, 0); c != cga16ColorPalette[1] {
+			t.Errorf("%s: background %v, want blue", tc.name, c)
+		}
+		for i, want := range tc.want {
+			if c := img.At(i+1, 0); c != want {
+				t.Errorf("%s: color %d = %v, want %v", tc.name, i+1, c, want)
+			}
+		}
+	}
+}
+
+func TestDecodeDetectCompression(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+		if i%4 == 3 {
+			m.Pix[i] = 0xff
+		}
+	}
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, m, &EncodeOptions{Compression: c}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		data[2] ^= 1 // mislabel the compression
+		img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{DetectCompression: true})
+		if err != nil {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+		if meta.Header.RLE != (c == CompressionRLE) {
+			t.Errorf("compression %d: header reports RLE %t", c, meta.Header.RLE)
+		}
+		if !bytes.Equal(img.(*image.RGBA).Pix, m.Pix) {
+			t.Errorf("compression %d: pixels differ", c)
+		}
+	}
+}
+
+func TestDecodePresetPalette(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 40)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, m, &EncodeOptions{Properties: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	shared := append(color.Palette(nil), palette.Plan9...)
+	for _, opts := range []DecodeOptions{
+		{Palette: shared},
+		{Palette: shared, VerifyPalette: true},
+		{Palette: shared, Trailer: true},
+	} {
+		img, meta, err := DecodeWithOptions(bytes.NewReader(data), &opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		p := img.(*image.Paletted)
+		if &p.Palette[0] != &shared[0] {
+			t.Errorf("%+v: palette not shared", opts)
+		}
+		if !bytes.Equal(p.Pix, m.Pix) {
+			t.Errorf("%+v: pixels = %v, want %v", opts, p.Pix, m.Pix)
+		}
+		if opts.Trailer && meta.Properties["k"] != "v" {
+			t.Errorf("trailer not read past the palette: %v", meta.Properties)
+		}
+	}
+
+	other := append(color.Palette(nil), palette.Plan9...)
+	other[200] = color.RGBA{1, 2, 3, 255}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Palette: other}); err != nil {
+		t.Errorf("unverified palette: %v", err)
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Palette: other, VerifyPalette: true}); err == nil {
+		t.Error("expected error for differing palette")
+	}
+	if other[200] != (color.RGBA{1, 2, 3, 255}) {
+		t.Error("preset palette modified")
+	}
+}
+
+func TestDecodePreferPalette(t *testing.T) {
+	hdr := makeHeader(5, 8, 1, 2, image.Rect(0, 0, 2, 1))
+	hdr[68] = 2
+	gray := append(hdr, rleLines([]byte{1, 0x80})...)
+	color8 := append(append([]byte{}, gray...), paletteMagic)
+	pal := make([]byte, 3*256)
+	copy(pal[3:], []byte{0xff, 0, 0})
+	color8 = append(color8, pal...)
+
+	img, _, err := DecodeWithOptions(bytes.NewReader(color8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("default: got %T, want *image.Gray", img)
+	}
+
+	for _, tc := range []struct {
+		data []byte
+		want color.Color
+	}{
+		{color8, color.RGBA{0xff, 0, 0, 0xff}},
+		{gray, color.Gray{1}},
+	} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(tc.data), &DecodeOptions{PreferPalette: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, ok := img.(*image.Paletted)
+		if !ok {
+			t.Fatalf("got %T, want *image.Paletted", img)
+		}
+		if c := p.At(0, 0); c != tc.want {
+			t.Errorf("pixel 0 = %v, want %v", c, tc.want)
+		}
+		if p.ColorIndexAt(1, 0) != 0x80 {
+			t.Errorf("index 1 = %#x, want 0x80", p.ColorIndexAt(1, 0))
+		}
+	}
+}
+
+func TestDecodePlanarEGAPalette(t *testing.T) {
+	for nplanes := 2; nplanes <= 4; nplanes++ {
+		n := 1 << uint(nplanes)
+		hdr := makeHeader(5, 1, nplanes, 2, image.Rect(0, 0, n, 1))
+		for i := 0; i < 16; i++ {
+			copy(hdr[16+i*3:], []byte{byte(i * 17), byte(0xff - i), byte(i)})
+		}
+		// Pixel x uses color index x, one bit per plane.
+		line := make([]byte, 2*nplanes)
+		for x := 0; x < n; x++ {
+			for p := 0; p < nplanes; p++ {
+				if x>>uint(p)&1 != 0 {
+					line[2*p+x/8] |= 0x80 >> uint(x%8)
+				}
+			}
+		}
+		img, err := Decode(bytes.NewReader(append(hdr, rleLines(line)...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := img.(*image.Paletted)
+		if len(p.Palette) != n {
+			t.Errorf("%d planes: %d colors, want %d", nplanes, len(p.Palette), n)
+		}
+		for x := 0; x < n; x++ {
+			want := color.RGBA{byte(x * 17), byte(0xff - x), byte(x), 0xff}
+			if c := p.At(x, 0); c != want {
+				t.Errorf("%d planes: pixel %d = %v, want %v", nplanes, x, c, want)
+			}
+		}
+	}
+}
+
+func TestDecodeFourthPlane(t *testing.T) {
+	hdr := makeHeader(5, 8, 4, 2, image.Rect(0, 0, 1, 1))
+	data := append(hdr, rleLines([]byte{0xff, 0, 0x80, 0, 0x40, 0, 0x80, 0})...)
+	for _, tc := range []struct {
+		plane FourthPlane
+		want  color.Color
+	}{
+		{FourthPlaneAlpha, color.RGBA{0xff, 0x80, 0x40, 0x80}},
+		{FourthPlaneOpaque, color.RGBA{0xff, 0x80, 0x40, 0xff}},
+		{FourthPlaneIntensity, color.RGBA{0x80, 0x40, 0x20, 0xff}},
+		{FourthPlaneCMYK, color.CMYK{0xff, 0x80, 0x40, 0x80}},
+	} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{FourthPlane: tc.plane})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := img.At(0, 0); c != tc.want {
+			t.Errorf("FourthPlane %d: got %v, want %v", tc.plane, c, tc.want)
+		}
+	}
+}
+
+func TestDecodeChannelMap(t *testing.T) {
+	rgb := append(makeHeader(5, 8, 3, 2, image.Rect(0, 0, 1, 1)), rleLines([]byte{1, 0, 2, 0, 3, 0})...)
+	rgba := append(makeHeader(5, 8, 4, 2, image.Rect(0, 0, 1, 1)), rleLines([]byte{1, 0, 2, 0, 3, 0, 4, 0})...)
+	for _, tc := range []struct {
+		data []byte
+		cm   [4]int
+		want color.RGBA
+	}{
+		{rgb, [4]int{}, color.RGBA{1, 2, 3, 0xff}},
+		{rgb, [4]int{1, 0, 2}, color.RGBA{2, 1, 3, 0xff}},
+		{rgb, [4]int{2, 0, 1}, color.RGBA{2, 3, 1, 0xff}},
+		{rgba, [4]int{1, 0, 2}, color.RGBA{2, 1, 3, 4}},
+		{rgba, [4]int{3, 0, 1, 2}, color.RGBA{2, 3, 4, 1}},
+	} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(tc.data), &DecodeOptions{ChannelMap: tc.cm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := img.At(0, 0); c != tc.want {
+			t.Errorf("%d planes, map %v: pixel = %v, want %v", tc.data[65], tc.cm, c, tc.want)
+		}
+	}
+	for _, cm := range [][4]int{{0, 0, 1}, {3, 1, 2}, {-1, 1, 2}} {
+		if _, _, err := DecodeWithOptions(bytes.NewReader(rgb), &DecodeOptions{ChannelMap: cm}); err == nil {
+			t.Errorf("map %v: expected error", cm)
+		}
+	}
+}
+
+func TestDecodeSkipBytes(t *testing.T) {
+	hdr := makeHeader(5, 8, 3, 2, image.Rect(0, 0, 1, 1))
+	data := append(hdr, 0xff, 0xc5, 0x00)
+	data = append(data, rleLines([]byte{1, 0, 2, 0, 3, 0})...)
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{SkipBytes: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(0, 0); c != (color.RGBA{1, 2, 3, 0xff}) {
+		t.Errorf("pixel = %v", c)
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{SkipBytes: 3, MaxBytesRead: 2}); err != ErrReadLimit {
+		t.Errorf("skip past read limit: got %v, want ErrReadLimit", err)
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data[:130]), &DecodeOptions{SkipBytes: 3}); err == nil {
+		t.Error("expected error skipping past the end")
+	}
+}
+
+func TestDecodeScanlineLengthPrefix(t *testing.T) {
+	hdr := makeHeader(5, 8, 1, 2, image.Rect(0, 0, 2, 2))
+	var data []byte
+	for y, line := range [][]byte{{1, 2}, {3, 3}} {
+		enc := rleLines(line)
+		if y == 0 {
+			enc = append(enc, 0xc7) // junk covered by the prefix
+		}
+		data = append(data, byte(len(enc)), byte(len(enc)>>8))
+		data = append(data, enc...)
+	}
+	data = append(append(hdr, data...), paletteMagic)
+	data = append(data, make([]byte, 3*256)...)
+
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{ScanlineLengthPrefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.(*image.Paletted).Pix; !bytes.Equal(got, []byte{1, 2, 3, 3}) {
+		t.Errorf("pixels = %v", got)
+	}
+
+	short := append([]byte{}, data...)
+	short[128] = 1 // the first scanline needs 2 bytes
+	if _, _, err := DecodeWithOptions(bytes.NewReader(short), &DecodeOptions{ScanlineLengthPrefix: true}); err == nil {
+		t.Error("expected error for a scanline past its prefix")
+	}
+}
+
+func TestDecodePaletteAlignmentPad(t *testing.T) {
+	// 128 header bytes and 3 bytes of pixel data leave the palette magic at
+	// an odd offset, so some tools insert a zero byte first.
+	hdr := makeHeader(5, 8, 1, 4, image.Rect(0, 0, 3, 1))
+	data := append(hdr, rleLines([]byte{1, 2, 2, 2})...)
+	data = append(data, 0, paletteMagic)
+	pal := make([]byte, 3*256)
+	copy(pal[3*2:], []byte{0x11, 0x22, 0x33})
+	data = append(data, pal...)
+
+	for _, strict := range []bool{false, true} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: strict})
+		if err != nil {
+			t.Fatalf("strict %v: %v", strict, err)
+		}
+		if c := img.At(1, 0); c != (color.RGBA{0x11, 0x22, 0x33, 0xff}) {
+			t.Errorf("strict %v: pixel = %v", strict, c)
+		}
+	}
+
+	// A nonzero stray byte is still an error when decoding strictly.
+	data[len(data)-768-2] = 0x55
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true}); err == nil {
+		t.Error("expected strict decode to reject a nonzero stray byte")
+	}
+}
+
+func TestDecodeExclusiveMax(t *testing.T) {
+	// A 2x2 image whose writer stored the exclusive maximum (2, 2).
+	hdr := makeHeader(5, 8, 1, 2, image.Rect(0, 0, 3, 3))
+	data := append(hdr, rleLines([]byte{1, 2}, []byte{3, 4})...)
+	data = append(data, paletteMagic)
+	data = append(data, make([]byte, 3*256)...)
+
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("expected error decoding 3 rows of a 2 row image")
+	}
+	img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{ExclusiveMax: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b != image.Rect(0, 0, 2, 2) || meta.Header.Window != b {
+		t.Fatalf("bounds = %v, window = %v", b, meta.Header.Window)
+	}
+	if got := img.(*image.Paletted).Pix; !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("pixels = %v", got)
+	}
+}
+
+func TestDecodeNewImageSeekPalette(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 5, 3), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 13)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	opts := &DecodeOptions{
+		NewImage: func(bounds image.Rectangle, model color.Model) draw.Image {
+			return image.NewNRGBA(bounds)
+		},
+	}
+	for _, tc := range []struct {
+		r        io.Reader
+		buffered bool
+	}{
+		{bytes.NewReader(buf.Bytes()), false},
+		{struct{ io.Reader }{bytes.NewReader(buf.Bytes())}, true},
+	} {
+		d, err := newDecoderWithOptions(tc.r, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := d.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.buffered != tc.buffered {
+			t.Errorf("%T: buffered = %v, want %v", tc.r, d.buffered, tc.buffered)
+		}
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				if !sameColor(img.At(x, y), m.At(x, y)) {
+					t.Fatalf("%T: pixel (%d,%d) = %v, want %v", tc.r, x, y, img.At(x, y), m.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// TestDecodeSeekPaletteTrailer checks that a palette at the end of the
+// stream that belongs to something else, here a thumbnail chunk, is not used.
+func TestDecodeSeekPaletteTrailer(t *testing.T) {
+	encode := func(c color.Color) []byte {
+		pal := make(color.Palette, 256)
+		for i := range pal {
+			pal[i] = color.Black
+		}
+		pal[1] = c
+		m := image.NewPaletted(image.Rect(0, 0, 4, 2), pal)
+		for i := range m.Pix {
+			m.Pix[i] = 1
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	red := color.RGBA{200, 0, 0, 0xff}
+	data := appendChunk(encode(red), ThumbnailTag, encode(color.RGBA{0, 0, 200, 0xff}))
+
+	calls := 0
+	opts := &DecodeOptions{
+		NewImage: func(bounds image.Rectangle, model color.Model) draw.Image {
+			calls++
+			return image.NewNRGBA(bounds)
+		},
+	}
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(3, 1); !sameColor(c, red) {
+		t.Errorf("pixel = %v, want %v", c, red)
+	}
+	if calls != 2 {
+		t.Errorf("NewImage called %d times, want 2 after the palette mismatch", calls)
+	}
+
+	// ReadPalette only reads through to the palette without seeking.
+	pal, err := ReadPalette(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(pal[1], red) {
+		t.Errorf("ReadPalette palette[1] = %v, want %v", pal[1], red)
+	}
+}
+
+func TestSafeDecode(t *testing.T) {
+	m := testRGBA(6, 4)
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	img, err := SafeDecode(bytes.NewReader(data), 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(img.At(5, 3), m.At(5, 3)) {
+		t.Errorf("pixel = %v, want %v", img.At(5, 3), m.At(5, 3))
+	}
+	if _, err := SafeDecode(bytes.NewReader(data), 23); err == nil {
+		t.Error("expected error for too many pixels")
+	}
+
+	// Zero-length runs produce no output, so without a read limit this
+	// stream would be read to the end.
+	hdr := makeHeader(5, 8, 1, 2, image.Rect(0, 0, 2, 2))
+	cr := &countingReader{r: io.MultiReader(bytes.NewReader(hdr), bytes.NewReader(bytes.Repeat([]byte{0xc0}, 1<<20)))}
+	if _, err := SafeDecode(cr, 4); err != ErrReadLimit {
+		t.Errorf("got %v, want ErrReadLimit", err)
+	}
+	if cr.n > 128+4096 {
+		t.Errorf("read %d bytes of a 4 pixel image", cr.n)
+	}
+
+	// Pixel data starting like a leading palette copy is decoded as pixels
+	// within the budget, leaving what follows unread.
+	pm := image.NewPaletted(image.Rect(0, 0, 4, 2), palette.Plan9)
+	pm.Pix[0] = paletteMagic
+	buf.Reset()
+	if err := EncodeWithOptions(&buf, pm, &EncodeOptions{Compression: CompressionNone}); err != nil {
+		t.Fatal(err)
+	}
+	br := bytes.NewReader(append(buf.Bytes(), make([]byte, 1000)...))
+	img, err = SafeDecode(br, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := img.(*image.Paletted); !ok || !bytes.Equal(p.Pix, pm.Pix) {
+		t.Errorf("image starting with the palette magic decoded as %v", img)
+	}
+	if br.Len() != 1000 {
+		t.Errorf("%d bytes left unread, want 1000", br.Len())
+	}
+}
+
+func TestDecodeStrictVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		ok      bool
+	}{
+		{0, true},
+		{2, true},
+		{3, true},
+		{4, true},
+		{5, true},
+		{1, false},
+		{6, false},
+		{0x0a, false},
+		{0xff, false},
+	} {
+		hdr := makeHeader(tc.version, 8, 3, 2, image.Rect(0, 0, 1, 1))
+		data := append(hdr, rleLines(make([]byte, 6))...)
+		_, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true})
+		if got := err == nil; got != tc.ok {
+			t.Errorf("version %d: strict decode error %v", tc.version, err)
+		}
+		if _, err := Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("version %d: lenient decode error %v", tc.version, err)
+		}
+	}
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	// Planes packed at a stride of 3 within 4 bytes per line.
+	hdr := makeHeader(5, 8, 4, 4, image.Rect(1, 2, 4, 4))
+	var lines [][]byte
+	for y := 0; y < 2; y++ {
+		l := make([]byte, 16)
+		for p := 0; p < 4; p++ {
+			for x := 0; x < 3; x++ {
+				l[3*p+x] = byte(0x40*p + 4*y + x)
+			}
+		}
+		lines = append(lines, l)
+	}
+	data := append(hdr, rleLines(lines...)...)
+	img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{FourthPlane: FourthPlaneCMYK, PlaneStride: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := img.(*image.CMYK)
+	if !ok {
+		t.Fatalf("got %T, want *image.CMYK", img)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			v := byte(4*y + x)
+			want := color.CMYK{v, 0x40 + v, 0x80 + v, 0xc0 + v}
+			if c := m.CMYKAt(1+x, 2+y); c != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+func TestDecodeUsePlanes(t *testing.T) {
+	hdr := makeHeader(5, 8, 8, 2, image.Rect(0, 0, 1, 1))
+	data := append(hdr, rleLines([]byte{1, 0, 2, 0, 3, 0, 4, 0, 9, 0, 9, 0, 9, 0, 9, 0})...)
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("expected 8 plane file to be rejected by default")
+	}
+	for _, tc := range []struct {
+		planes int
+		want   color.RGBA
+	}{
+		{3, color.RGBA{1, 2, 3, 0xff}},
+		{4, color.RGBA{1, 2, 3, 4}},
+	} {
+		img, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{UsePlanes: tc.planes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := img.At(0, 0); c != tc.want {
+			t.Errorf("UsePlanes %d: pixel = %v, want %v", tc.planes, c, tc.want)
+		}
+	}
+	if _, _, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{UsePlanes: 2}); err == nil {
+		t.Error("expected error for UsePlanes 2")
+	}
+}
+
+// TestDecodeLeadingPaletteLookalike checks that pixel data that starts like
+// a leading palette copy decodes as pixels unless LeadingPalette is set, and
+// that leading palettes are skipped when decoding into a NewImage from a
+// seekable reader.
+func TestDecodeLeadingPaletteLookalike(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 40, 40), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = paletteMagic
+	}
+	m.Pix[len(m.Pix)-1] = 3
+	newImage := func(bounds image.Rectangle, model color.Model) draw.Image {
+		return image.NewNRGBA(bounds)
+	}
+	for _, opts := range []*EncodeOptions{{Compression: CompressionNone}, {LeadingPalette: true}} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		lp := opts.LeadingPalette
+		for _, do := range []*DecodeOptions{{LeadingPalette: lp}, {LeadingPalette: lp, NewImage: newImage}} {
+			img, _, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), do)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []image.Point{{0, 0}, {39, 39}} {
+				if got, want := img.At(p.X, p.Y), m.At(p.X, p.Y); !sameColor(got, want) {
+					t.Errorf("%+v: pixel %v = %v, want %v", opts, p, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pcx
+
+import "image"
+
+// Dither selects how the encoder reduces 16-bit samples to the 8 bits PCX
+// stores.
+type Dither int
+
+const (
+	// DitherNone rounds every sample to the nearest 8-bit level.
+	DitherNone Dither = iota
+	// DitherOrdered adds a 4x4 Bayer threshold pattern before rounding.
+	DitherOrdered
+	// DitherFloydSteinberg diffuses the rounding error of every sample to
+	// its unvisited neighbors.
+	DitherFloydSteinberg
+)
+
+// bayer4 is the 4x4 Bayer threshold matrix.
+var bayer4 = [4][4]int32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// dither reduces the w by h 16-bit samples returned by at to 8 bits with
+// method d, passing each result to set. Coordinates are relative to the top
+// left corner.
+func dither(d Dither, w, h int, at func(x, y int) uint16, set func(x, y int, v uint8)) {
+	quantize := func(v int32) (uint8, int32) {
+		q := (v + 0x101/2) / 0x101
+		if q < 0 {
+			q = 0
+		} else if q > 0xff {
+			q = 0xff
+		}
+		return uint8(q), v - q*0x101
+	}
+	switch d {
+	case DitherOrdered:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				// Spread the thresholds evenly over one 8-bit step.
+				off := (2*bayer4[y&3][x&3]+1)*0x101/32 - 0x101/2
+				q, _ := quantize(int32(at(x, y)) + off)
+				set(x, y, q)
+			}
+		}
+	case DitherFloydSteinberg:
+		// The error rows have a column of slack on either side.
+		cur := make([]int32, w+2)
+		next := make([]int32, w+2)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				q, e := quantize(int32(at(x, y)) + cur[x+1]/16)
+				set(x, y, q)
+				cur[x+2] += 7 * e
+				next[x] += 3 * e
+				next[x+1] += 5 * e
+				next[x+2] += e
+			}
+			cur, next = next, cur
+			for i := range next {
+				next[i] = 0
+			}
+		}
+	default:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				q, _ := quantize(int32(at(x, y)))
+				set(x, y, q)
+			}
+		}
+	}
+}
+
+// ditherGray16 reduces m to 8 bits per pixel with method d.
+func ditherGray16(m *image.Gray16, d Dither) *image.Gray {
+	b := m.Bounds()
+	out := image.NewGray(b)
+	dither(d, b.Dx(), b.Dy(), func(x, y int) uint16 {
+		return m.Gray16At(b.Min.X+x, b.Min.Y+y).Y
+	}, func(x, y int, v uint8) {
+		out.Pix[y*out.Stride+x] = v
+	})
+	return out
+}
+
+// ditherRGBA64 reduces m to 8 bits per channel, dithering the color channels
+// with method d. Alpha is rounded, and the colors are kept within it so that
+// the result is a valid premultiplied color.
+func ditherRGBA64(m *image.RGBA64, d Dither) *image.RGBA {
+	b := m.Bounds()
+	out := image.NewRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			a := uint32(m.RGBA64At(b.Min.X+x, b.Min.Y+y).A)
+			out.Pix[y*out.Stride+x*4+3] = uint8((a + 0x101/2) / 0x101)
+		}
+	}
+	for c := 0; c < 3; c++ {
+		c := c
+		dither(d, b.Dx(), b.Dy(), func(x, y int) uint16 {
+			i := m.PixOffset(b.Min.X+x, b.Min.Y+y) + 2*c
+			return uint16(m.Pix[i])<<8 | uint16(m.Pix[i+1])
+		}, func(x, y int, v uint8) {
+			i := y*out.Stride + x*4
+			if a := out.Pix[i+3]; v > a {
+				v = a
+			}
+			out.Pix[i+c] = v
+		})
+	}
+	return out
+}
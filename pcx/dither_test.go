@@ -0,0 +1,71 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeDither(t *testing.T) {
+	// Every sample lies a quarter of the way from one 8-bit level to the
+	// next, so dithering sets about one pixel in four to the higher level.
+	const v = 128*0x101 + 0x40
+	b := image.Rect(0, 0, 16, 16)
+	gray := image.NewGray16(b)
+	rgba := image.NewRGBA64(b)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			gray.SetGray16(x, y, color.Gray16{v})
+			rgba.SetRGBA64(x, y, color.RGBA64{v, 0, v, 0xffff})
+		}
+	}
+	for _, d := range []Dither{DitherNone, DitherOrdered, DitherFloydSteinberg} {
+		for _, m := range []image.Image{gray, rgba} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, m, &EncodeOptions{Dither: d}); err != nil {
+				t.Fatal(err)
+			}
+			img, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := img.(*image.Gray); ok != (m == gray) {
+				t.Errorf("dither %d: %T decoded as %T", d, m, img)
+			}
+			sum := 0
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					r, _, _, _ := img.At(x, y).RGBA()
+					sum += int(r >> 8)
+				}
+			}
+			mean := float64(sum) / 256
+			want := 128.25
+			if d == DitherNone {
+				want = 128
+			}
+			if mean < want-0.05 || mean > want+0.05 {
+				t.Errorf("dither %d: %T mean level %v, want %v", d, m, mean, want)
+			}
+		}
+	}
+
+	// Without dithering, samples round to the nearest level.
+	gray.SetGray16(0, 0, color.Gray16{0x10a0})
+	var buf bytes.Buffer
+	if err := Encode(&buf, gray); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray); !ok || g.GrayAt(0, 0).Y != 0x11 {
+		t.Errorf("Gray16 %#x decoded as %v, want gray 0x11", 0x10a0, img.At(0, 0))
+	}
+
+	if err := EncodeWithOptions(&bytes.Buffer{}, gray, &EncodeOptions{Dither: -1}); err == nil {
+		t.Error("expected error for invalid dither")
+	}
+}
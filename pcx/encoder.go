@@ -1,51 +1,577 @@
 package pcx
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"math"
+	"sort"
 )
 
+// EncodeOptions controls optional encoder behavior. The zero value encodes
+// exactly like Encode.
+type EncodeOptions struct {
+	// MirrorHorizontal reverses the order of pixels within every scanline.
+	MirrorHorizontal bool
+
+	// Compression selects how scanlines are stored. The default is
+	// CompressionRLE.
+	Compression Compression
+
+	// PaletteKey, if set, sorts the palette of paletted images by ascending
+	// key before encoding and remaps the color indices to match. Colors with
+	// equal keys are ordered by their RGBA values and duplicate colors are
+	// merged, so the same logical image always produces the same output
+	// regardless of its palette order.
+	PaletteKey func(c color.Color) float64
+
+	// HorizDPI and VertDPI set the resolution stored in the header. If only
+	// one is set it is used for both axes, and if neither is set both are
+	// DefaultDPI.
+	HorizDPI, VertDPI int
+
+	// HorizResolution and VertResolution, if positive, override HorizDPI
+	// and VertDPI respectively, rounded to whole dots per inch.
+	HorizResolution, VertResolution Resolution
+
+	// Chunks are written after the image in the layout described by Chunk.
+	Chunks []Chunk
+
+	// Properties, if not empty, are written after the image in a
+	// PropertiesTag chunk, following any Chunks.
+	Properties map[string]string
+
+	// Cycles, if not empty, are written after the image in a CyclesTag
+	// chunk, following any Properties.
+	Cycles []CycleRange
+
+	// KeepPaletteLength records the number of colors of paletted images
+	// with fewer than 256 in a PaletteLengthTag chunk after the image,
+	// following any other chunks, so that they decode with the same palette
+	// length. Otherwise the extended palette is padded to 256 colors.
+	KeepPaletteLength bool
+
+	// Transparent, if set, records TransparentIndex as the transparent
+	// palette index in a TransparencyTag chunk after the image, following any
+	// Cycles. PCX itself has no notion of transparency.
+	Transparent      bool
+	TransparentIndex uint8
+
+	// RLEStrategy, if set, run-length encodes the scanlines of Encode and
+	// EncodeWithOptions in place of GreedyRLE, for example to try a run
+	// splitter that minimizes escaped literals. It must produce the
+	// standard encoding, so it cannot be combined with RLEThreshold.
+	RLEStrategy RLEStrategy
+
+	// RLEThreshold selects the run-length encoding of a PCX-like variant as
+	// described by DecodeOptions.RLEThreshold. It also sets the longest run,
+	// the length bits below the threshold: 63 for the default of 0xc0,
+	// which standard files must use, and 127 for 0x80.
+	RLEThreshold byte
+
+	// PadWithEdge pads scanlines of images with an odd width, which PCX
+	// stores with an even number of bytes, with a copy of the last pixel
+	// rather than 0, extending the final run.
+	PadWithEdge bool
+
+	// Progress, if set, is called after each scanline is written with the
+	// number of scanlines written so far and the image height.
+	Progress func(rowsDone, rowsTotal int)
+
+	// Version is the version byte written to the header, one of 2, 3, 4
+	// or 5, to mimic the header of a particular tool. Zero selects the
+	// default of 5, so version 0 (PC Paintbrush 2.5) headers cannot be
+	// written.
+	Version int
+
+	// Reserved is written to the reserved header byte at offset 64, which
+	// some tools set to nonzero values.
+	Reserved byte
+
+	// HeaderPalette writes paletted images of at most 16 colors with 4 bits
+	// per pixel and their palette in the header colormap, omitting the 769
+	// byte extended palette. Images with more colors are written as usual.
+	HeaderPalette bool
+
+	// GrayPalette appends a gray ramp extended palette to grayscale images,
+	// which their grayscale flag makes redundant, for viewers that read the
+	// extended palette of every 8bpp image.
+	GrayPalette bool
+
+	// ImplicitGrayRamp writes *image.Paletted images whose palette is exactly
+	// the 256 level gray ramp as grayscale, without the extended palette the
+	// grayscale flag makes redundant. They decode as *image.Gray.
+	ImplicitGrayRamp bool
+
+	// PaletteAlpha writes *image.Paletted images whose palette has a color
+	// that is not fully opaque as 4-plane RGBA, with each pixel's palette
+	// alpha in the fourth plane, rather than as paletted images, whose
+	// extended palette cannot hold alpha.
+	PaletteAlpha bool
+
+	// Dither selects how *image.Gray16 and *image.RGBA64 images are reduced
+	// to 8 bits per sample. *image.Gray16 images are always written as
+	// grayscale; without dithering, *image.RGBA64 images are written like
+	// other images, keeping the high byte of each sample.
+	Dither Dither
+
+	// LeadingPalette also writes the 769 byte extended palette of 8bpp
+	// paletted images directly after the header, where some legacy viewers
+	// look for it. This is not standard: readers take it for pixel data
+	// unless told otherwise, as with DecodeOptions.LeadingPalette. The
+	// trailing palette is written as usual.
+	LeadingPalette bool
+
+	// Background is the color that translucent pixels of truecolor images
+	// are composited over, since the encoded planes carry no alpha. The
+	// default is black.
+	Background color.Color
+}
+
+// Values of the header's palette info field.
+const (
+	paletteInfoColor = 1 // color or monochrome
+	paletteInfoGray  = 2
+)
+
+// DefaultDPI is the resolution written when EncodeOptions sets none.
+const DefaultDPI = 300
+
+// dpi returns the horizontal and vertical resolution to write.
+func (o *EncodeOptions) dpi() (int, int) {
+	h, v := o.HorizDPI, o.VertDPI
+	if o.HorizResolution > 0 {
+		h = o.HorizResolution.header()
+	}
+	if o.VertResolution > 0 {
+		v = o.VertResolution.header()
+	}
+	switch {
+	case h == 0 && v == 0:
+		return DefaultDPI, DefaultDPI
+	case h == 0:
+		return v, v
+	case v == 0:
+		return h, h
+	}
+	return h, v
+}
+
+// background returns the color to flatten translucent pixels against.
+func (o *EncodeOptions) background() color.RGBA64 {
+	if o.Background == nil {
+		return color.RGBA64{}
+	}
+	return color.RGBA64Model.Convert(o.Background).(color.RGBA64)
+}
+
+// flatten composites the alpha-premultiplied color r, g, b, a over bg and
+// returns the 8-bit components of the result.
+func flatten(r, g, b, a uint32, bg color.RGBA64) (uint8, uint8, uint8) {
+	t := 0xffff - a
+	r += uint32(bg.R) * t / 0xffff
+	g += uint32(bg.G) * t / 0xffff
+	b += uint32(bg.B) * t / 0xffff
+	return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)
+}
+
+// check reports an error if the options select an unknown PCX version, RLE
+// threshold or dither, or options that conflict.
+func (o *EncodeOptions) check() error {
+	switch o.Version {
+	case 0, 2, 3, 4, 5:
+	default:
+		return fmt.Errorf("pcx: invalid version %d", o.Version)
+	}
+	if !validRLEThreshold(o.RLEThreshold) {
+		return fmt.Errorf("pcx: invalid RLE threshold %#x", o.RLEThreshold)
+	}
+	if o.RLEStrategy != nil && o.RLEThreshold != 0 {
+		return errors.New("pcx: RLEStrategy cannot be combined with RLEThreshold")
+	}
+	if o.Dither < DitherNone || o.Dither > DitherFloydSteinberg {
+		return fmt.Errorf("pcx: invalid dither %d", o.Dither)
+	}
+	return nil
+}
+
+// progress reports that rows of total scanlines have been written.
+func (o *EncodeOptions) progress(rows, total int) {
+	if o.Progress != nil {
+		o.Progress(rows, total)
+	}
+}
+
+// Luminance returns the Rec. 601 luma of c in the range [0, 0xffff]. It can be
+// used as EncodeOptions.PaletteKey.
+func Luminance(c color.Color) float64 {
+	return float64(color.Gray16Model.Convert(c).(color.Gray16).Y)
+}
+
+// Compression selects how the encoder stores scanline data.
+type Compression int
+
+const (
+	// CompressionRLE run-length encodes every scanline.
+	CompressionRLE Compression = iota
+	// CompressionNone stores scanlines verbatim and clears the RLE flag.
+	CompressionNone
+	// CompressionAuto uses whichever of CompressionRLE and CompressionNone
+	// produces the smaller file.
+	CompressionAuto
+)
+
+// column returns the source column offset, relative to the left edge, of the
+// i'th pixel written in a scanline of the given width.
+func (o *EncodeOptions) column(i, width int) int {
+	if o.MirrorHorizontal {
+		return width - 1 - i
+	}
+	return i
+}
+
+// palette returns the palette to write for p and the mapping from the image's
+// color indices to indices into that palette.
+func (o *EncodeOptions) palette(p color.Palette) (color.Palette, *[256]uint8) {
+	var remap [256]uint8
+	for i := range remap {
+		remap[i] = uint8(i)
+	}
+	if o.PaletteKey == nil {
+		return p, &remap
+	}
+	if len(p) > len(remap) {
+		p = p[:len(remap)]
+	}
+	type entry struct {
+		key        float64
+		r, g, b, a uint32
+		index      int
+	}
+	entries := make([]entry, len(p))
+	for i, c := range p {
+		r, g, b, a := c.RGBA()
+		entries[i] = entry{o.PaletteKey(c), r, g, b, a, i}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ei, ej := entries[i], entries[j]
+		switch {
+		case ei.key != ej.key:
+			return ei.key < ej.key
+		case ei.r != ej.r:
+			return ei.r < ej.r
+		case ei.g != ej.g:
+			return ei.g < ej.g
+		case ei.b != ej.b:
+			return ei.b < ej.b
+		case ei.a != ej.a:
+			return ei.a < ej.a
+		}
+		// Keep the sort, which is not stable, deterministic.
+		return ei.index < ej.index
+	})
+	sorted := make(color.Palette, 0, len(entries))
+	for i, e := range entries {
+		if i == 0 || e.r != entries[i-1].r || e.g != entries[i-1].g || e.b != entries[i-1].b || e.a != entries[i-1].a {
+			sorted = append(sorted, p[e.index])
+		}
+		remap[e.index] = uint8(len(sorted) - 1)
+	}
+	return sorted, &remap
+}
+
+// newLine returns a scanline buffer with room for n bytes that stores its
+// contents as selected by the options.
+func (o *EncodeOptions) newLine(n int) *rleBuffer {
+	return &rleBuffer{b: make([]byte, n), raw: o.Compression == CompressionNone, edge: o.PadWithEdge, threshold: o.RLEThreshold, strategy: o.RLEStrategy}
+}
+
 // Encode writes the Image m to w in PCX format.
 func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions writes the Image m to w in PCX format, honoring opts. A
+// nil opts is equivalent to the zero EncodeOptions.
+func EncodeWithOptions(w io.Writer, m image.Image, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if err := opts.check(); err != nil {
+		return err
+	}
+	if opts.Compression == CompressionAuto {
+		o := *opts
+		o.Progress = nil
+		o.Compression = CompressionNone
+		raw, err := EncodedSize(m, &o)
+		if err != nil {
+			return err
+		}
+		o.Compression = CompressionRLE
+		rle, err := EncodedSize(m, &o)
+		if err != nil {
+			return err
+		}
+		if raw < rle {
+			o.Compression = CompressionNone
+		}
+		o.Progress = opts.Progress
+		opts = &o
+	}
+	if err := encodeImage(w, m, opts); err != nil {
+		return err
+	}
+	paletteLen := 0
+	if p, ok := m.ColorModel().(color.Palette); ok && opts.KeepPaletteLength && !paletteAsRGBA(m, opts) {
+		if _, ok := m.(image.PalettedImage); ok {
+			pal, _ := opts.palette(p)
+			paletteLen = len(pal)
+		}
+	}
+	return writeTrailer(w, opts, paletteLen)
+}
+
+// paletteAsRGBA reports whether m is a paletted image that
+// EncodeOptions.PaletteAlpha has written as RGBA planes.
+func paletteAsRGBA(m image.Image, opts *EncodeOptions) bool {
+	im, ok := m.(*image.Paletted)
+	return ok && opts.PaletteAlpha && !opaquePalette(im.Palette)
+}
+
+func encodeImage(w io.Writer, m image.Image, opts *EncodeOptions) error {
 	switch im := m.(type) {
 	case *image.RGBA:
-		return encodeRGBA(w, im)
+		return encodeRGBA(w, im, opts)
 	case *image.Paletted:
-		return encodePaletted(w, im)
+		if paletteAsRGBA(im, opts) {
+			return encodePalettedRGBA(w, im, opts)
+		}
+		if opts.HeaderPalette {
+			if pal, remap := opts.palette(im.Palette); len(pal) <= 16 {
+				return encodeHeaderPaletted(w, im, pal, remap, opts)
+			}
+		}
+		return encodePaletted(w, im, opts)
+	case *image.Gray:
+		return encodeGray(w, im, opts)
+	case *image.Gray16:
+		return encodeGray(w, ditherGray16(im, opts.Dither), opts)
+	case *image.RGBA64:
+		if opts.Dither != DitherNone {
+			return encodeRGBA(w, ditherRGBA64(im, opts.Dither), opts)
+		}
+	case *image.Uniform:
+		return errors.New("pcx: cannot encode an unbounded image.Uniform, use EncodeSolid")
+	case rgbaAtImage:
+		return encodeTruecolor(w, im.Bounds(), func(x, y int) (uint32, uint32, uint32, uint32) {
+			c := im.RGBAAt(x, y)
+			return uint32(c.R) * 0x101, uint32(c.G) * 0x101, uint32(c.B) * 0x101, uint32(c.A) * 0x101
+		}, opts)
+	case nrgbaAtImage:
+		return encodeTruecolor(w, im.Bounds(), func(x, y int) (uint32, uint32, uint32, uint32) {
+			return im.NRGBAAt(x, y).RGBA()
+		}, opts)
 	case image.PalettedImage:
 		cm := im.ColorModel()
 		if p, ok := cm.(color.Palette); ok {
-			return encodePalettedImage(w, im, p)
+			if opts.HeaderPalette {
+				if pal, remap := opts.palette(p); len(pal) <= 16 {
+					return encodeHeaderPaletted(w, im, pal, remap, opts)
+				}
+			}
+			return encodePalettedImage(w, im, p, opts)
 		}
 	}
-	return encodeGeneric(w, m)
+	return encodeGeneric(w, m, opts)
 }
 
-func encodeGeneric(w io.Writer, m image.Image) error {
-	b := m.Bounds()
+// EncodedSize returns the number of bytes EncodeWithOptions would write for m
+// with the given options.
+func EncodedSize(m image.Image, opts *EncodeOptions) (int, error) {
+	cw := &countingWriter{}
+	err := EncodeWithOptions(cw, m, opts)
+	return cw.n, err
+}
+
+// EncodeToBuffer writes m to dst like Encode and returns the number of bytes
+// written. If dst is too small it returns io.ErrShortBuffer; EncodedSize
+// reports the size needed. *image.Paletted and *image.Gray images are
+// encoded without allocating.
+func EncodeToBuffer(dst []byte, m image.Image) (int, error) {
+	switch m := m.(type) {
+	case *image.Paletted:
+		return encode8BitToBuffer(dst, m.Rect, m.Pix, m.Stride, m.Palette)
+	case *image.Gray:
+		return encode8BitToBuffer(dst, m.Rect, m.Pix, m.Stride, nil)
+	}
+	sw := &sliceWriter{b: dst}
+	err := Encode(sw, m)
+	return sw.n, err
+}
+
+// encode8BitToBuffer stores the single plane 8bpp image with bounds b and
+// pixels pix in dst as encodePaletted and encodeGray write it with the
+// default options, followed by the extended palette pal unless it is nil.
+func encode8BitToBuffer(dst []byte, b image.Rectangle, pix []byte, stride int, pal color.Palette) (int, error) {
 	odd := b.Dx() & 1
 	bytesPerLine := b.Dx() + odd
-	if err := writeHeader(w, 8, 3, bytesPerLine, b, nil); err != nil {
+	if err := checkHeader(bytesPerLine, b); err != nil {
+		return 0, err
+	}
+	if len(dst) < 128 {
+		return 0, io.ErrShortBuffer
+	}
+	info := paletteInfoGray
+	if pal != nil {
+		info = paletteInfoColor
+	}
+	var opts EncodeOptions
+	putHeader(dst, 8, 1, bytesPerLine, b, nil, info, &opts)
+	n := 128
+	width := b.Dx()
+	var line rleBuffer
+	for y := 0; y < b.Dy(); y++ {
+		// Encode straight into dst, which append only leaves once full.
+		line.b = dst[n:n:len(dst)]
+		row := pix[y*stride:]
+		for x := 0; x < width; x++ {
+			line.put(row[x])
+		}
+		if odd != 0 {
+			line.pad()
+		}
+		out := line.flush()
+		if len(out) > len(dst)-n {
+			copy(dst[n:], out)
+			return len(dst), io.ErrShortBuffer
+		}
+		n += len(out)
+	}
+	if pal == nil {
+		return n, nil
+	}
+	if len(dst)-n < 3*256+1 {
+		return n, io.ErrShortBuffer
+	}
+	putExtendedPalette(dst[n:], pal)
+	return n + 3*256 + 1, nil
+}
+
+// sliceWriter writes into a fixed slice, failing once it is full.
+type sliceWriter struct {
+	b []byte
+	n int
+}
+
+func (s *sliceWriter) Write(p []byte) (int, error) {
+	n := copy(s.b[s.n:], p)
+	s.n += n
+	if n < len(p) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// RoundTrip encodes m with Encode and decodes the result, to check how m
+// survives the PCX format. Opaque *image.RGBA, *image.Gray and *image.Paletted
+// images round-trip without loss, although palettes are padded to 256 colors.
+// Other images are converted to 24-bit RGB with translucent pixels
+// composited over black.
+func RoundTrip(m image.Image) (image.Image, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		return nil, err
+	}
+	return Decode(&buf)
+}
+
+// IsLossless reports whether RoundTrip returns an image of the same type as
+// m with the same bounds and pixels: *image.Gray images, *image.RGBA images
+// that are fully opaque, and *image.Paletted images whose palette holds at
+// most 256 opaque colors with 8 bits per channel. Palette padding is not
+// considered a loss.
+func IsLossless(m image.Image) bool {
+	switch m := m.(type) {
+	case *image.Gray:
+		return true
+	case *image.RGBA:
+		return m.Opaque()
+	case *image.Paletted:
+		if len(m.Palette) > 256 {
+			return false
+		}
+		for _, c := range m.Palette {
+			r, g, b, a := c.RGBA()
+			if a != 0xffff || r%0x101 != 0 || g%0x101 != 0 || b%0x101 != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// countingWriter discards everything written to it while counting the bytes.
+type countingWriter struct {
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
+
+// rgbaAtImage is implemented by images with direct access to their pixels as
+// color.RGBA, such as *image.RGBA.
+type rgbaAtImage interface {
+	image.Image
+	RGBAAt(x, y int) color.RGBA
+}
+
+// nrgbaAtImage is implemented by images with direct access to their pixels as
+// color.NRGBA, such as *image.NRGBA.
+type nrgbaAtImage interface {
+	image.Image
+	NRGBAAt(x, y int) color.NRGBA
+}
+
+func encodeGeneric(w io.Writer, m image.Image, opts *EncodeOptions) error {
+	return encodeTruecolor(w, m.Bounds(), func(x, y int) (uint32, uint32, uint32, uint32) {
+		return m.At(x, y).RGBA()
+	}, opts)
+}
+
+// encodeTruecolor writes the image with bounds b whose alpha-premultiplied
+// pixels are returned by at as a 24-bit image.
+func encodeTruecolor(w io.Writer, b image.Rectangle, at func(x, y int) (r, g, b, a uint32), opts *EncodeOptions) error {
+	odd := b.Dx() & 1
+	bytesPerLine := b.Dx() + odd
+	if err := writeHeader(w, 8, 3, bytesPerLine, b, nil, paletteInfoColor, opts); err != nil {
 		return err
 	}
-	rline := &rleBuffer{b: make([]byte, b.Dx())}
-	gline := &rleBuffer{b: make([]byte, b.Dx())}
-	bline := &rleBuffer{b: make([]byte, b.Dx())}
+	bg := opts.background()
+	rline := opts.newLine(b.Dx())
+	gline := opts.newLine(b.Dx())
+	bline := opts.newLine(b.Dx())
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		rline.reset()
 		gline.reset()
 		bline.reset()
-		for x := b.Min.X; x < b.Max.X; x++ {
-			r, g, b, _ := m.At(x, y).RGBA()
-			rline.put(byte(r >> 8))
-			gline.put(byte(g >> 8))
-			bline.put(byte(b >> 8))
+		for i := 0; i < b.Dx(); i++ {
+			r, g, b, a := at(b.Min.X+opts.column(i, b.Dx()), y)
+			r8, g8, b8 := flatten(r, g, b, a, bg)
+			rline.put(r8)
+			gline.put(g8)
+			bline.put(b8)
 		}
 		if odd != 0 {
-			rline.put(0)
-			gline.put(0)
-			bline.put(0)
+			rline.pad()
+			gline.pad()
+			bline.pad()
 		}
 		if _, err := w.Write(rline.flush()); err != nil {
 			return err
@@ -56,37 +582,46 @@ func encodeGeneric(w io.Writer, m image.Image) error {
 		if _, err := w.Write(bline.flush()); err != nil {
 			return err
 		}
+		opts.progress(y-b.Min.Y+1, b.Dy())
 	}
 	return nil
 }
 
-func encodeRGBA(w io.Writer, m *image.RGBA) error {
+func encodeRGBA(w io.Writer, m *image.RGBA, opts *EncodeOptions) error {
 	b := m.Bounds()
 	odd := b.Dx() & 1
 	bytesPerLine := b.Dx() + odd
-	if err := writeHeader(w, 8, 3, bytesPerLine, b, nil); err != nil {
+	if err := writeHeader(w, 8, 3, bytesPerLine, b, nil, paletteInfoColor, opts); err != nil {
 		return err
 	}
 	width := b.Dx()
 	height := b.Dy()
-	rline := &rleBuffer{b: make([]byte, width)}
-	gline := &rleBuffer{b: make([]byte, width)}
-	bline := &rleBuffer{b: make([]byte, width)}
+	bg := opts.background()
+	rline := opts.newLine(width)
+	gline := opts.newLine(width)
+	bline := opts.newLine(width)
 	for y := 0; y < height; y++ {
 		rline.reset()
 		gline.reset()
 		bline.reset()
-		o := y * m.Stride
+		row := m.Pix[y*m.Stride:]
 		for x := 0; x < width; x++ {
-			rline.put(m.Pix[o])
-			gline.put(m.Pix[o+1])
-			bline.put(m.Pix[o+2])
-			o += 4
+			o := opts.column(x, width) * 4
+			if row[o+3] == 0xff {
+				rline.put(row[o])
+				gline.put(row[o+1])
+				bline.put(row[o+2])
+				continue
+			}
+			r, g, b := flatten(uint32(row[o])*0x101, uint32(row[o+1])*0x101, uint32(row[o+2])*0x101, uint32(row[o+3])*0x101, bg)
+			rline.put(r)
+			gline.put(g)
+			bline.put(b)
 		}
 		if odd != 0 {
-			rline.put(0)
-			gline.put(0)
-			bline.put(0)
+			rline.pad()
+			gline.pad()
+			bline.pad()
 		}
 		if _, err := w.Write(rline.flush()); err != nil {
 			return err
@@ -97,65 +632,387 @@ func encodeRGBA(w io.Writer, m *image.RGBA) error {
 		if _, err := w.Write(bline.flush()); err != nil {
 			return err
 		}
+		opts.progress(y+1, height)
 	}
 	return nil
 }
 
-func encodePaletted(w io.Writer, m *image.Paletted) error {
+// opaquePalette reports whether every color of p is fully opaque.
+func opaquePalette(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
+
+// encodePalettedRGBA writes m as a 4-plane image, resolving each index through
+// the palette so that its alpha is kept in the fourth plane.
+func encodePalettedRGBA(w io.Writer, m *image.Paletted, opts *EncodeOptions) error {
+	var pal [256]color.RGBA
+	for i, c := range m.Palette {
+		if i == len(pal) {
+			break
+		}
+		pal[i] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	return encodeFourPlanes(w, m.Bounds(), func(x, y int) color.RGBA {
+		return pal[m.Pix[y*m.Stride+x]]
+	}, opts)
+}
+
+// encodeRGBAPlanes writes m as a 4-plane image holding its premultiplied
+// components as they are, which the decoder reads back unchanged.
+func encodeRGBAPlanes(w io.Writer, m *image.RGBA, opts *EncodeOptions) error {
+	return encodeFourPlanes(w, m.Bounds(), func(x, y int) color.RGBA {
+		o := y*m.Stride + x*4
+		return color.RGBA{m.Pix[o], m.Pix[o+1], m.Pix[o+2], m.Pix[o+3]}
+	}, opts)
+}
+
+// encodeFourPlanes writes an image with bounds b as 4 planes of red, green,
+// blue and alpha, taking the pixel at (x, y) relative to the top left corner
+// from at.
+func encodeFourPlanes(w io.Writer, b image.Rectangle, at func(x, y int) color.RGBA, opts *EncodeOptions) error {
+	odd := b.Dx() & 1
+	bytesPerLine := b.Dx() + odd
+	if err := writeHeader(w, 8, 4, bytesPerLine, b, nil, paletteInfoColor, opts); err != nil {
+		return err
+	}
+	width := b.Dx()
+	height := b.Dy()
+	lines := [4]*rleBuffer{}
+	for i := range lines {
+		lines[i] = opts.newLine(width)
+	}
+	for y := 0; y < height; y++ {
+		for _, l := range lines {
+			l.reset()
+		}
+		for x := 0; x < width; x++ {
+			c := at(opts.column(x, width), y)
+			lines[0].put(c.R)
+			lines[1].put(c.G)
+			lines[2].put(c.B)
+			lines[3].put(c.A)
+		}
+		for _, l := range lines {
+			if odd != 0 {
+				l.pad()
+			}
+			if _, err := w.Write(l.flush()); err != nil {
+				return err
+			}
+		}
+		opts.progress(y+1, height)
+	}
+	return nil
+}
+
+// EncodeRGBAWithMask writes rgb to w as a 4-plane PCX image whose fourth
+// plane holds the luminance of mask, which must have the same size as rgb, as
+// alpha. Any alpha of rgb itself is ignored. Like all 4-plane images, the
+// colors are written premultiplied by the alpha.
+func EncodeRGBAWithMask(w io.Writer, rgb, mask image.Image) error {
+	b, mb := rgb.Bounds(), mask.Bounds()
+	if b.Size() != mb.Size() {
+		return errors.New("pcx: mask size does not match image")
+	}
+	return encodeFourPlanes(w, b, func(x, y int) color.RGBA {
+		c := color.NRGBAModel.Convert(rgb.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+		c.A = color.GrayModel.Convert(mask.At(mb.Min.X+x, mb.Min.Y+y)).(color.Gray).Y
+		return color.RGBAModel.Convert(c).(color.RGBA)
+	}, &EncodeOptions{})
+}
+
+func encodeGray(w io.Writer, m *image.Gray, opts *EncodeOptions) error {
 	b := m.Bounds()
 	odd := b.Dx() & 1
 	bytesPerLine := b.Dx() + odd
-	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil); err != nil {
+	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil, paletteInfoGray, opts); err != nil {
 		return err
 	}
+	var pal color.Palette
+	if opts.GrayPalette {
+		pal = make(color.Palette, 256)
+		for i := range pal {
+			pal[i] = color.Gray{uint8(i)}
+		}
+		if err := opts.leadingPalette(w, pal); err != nil {
+			return err
+		}
+	}
 	width := b.Dx()
 	height := b.Dy()
-	line := &rleBuffer{b: make([]byte, width)}
+	line := opts.newLine(width)
 	for y := 0; y < height; y++ {
 		line.reset()
-		o := y * m.Stride
+		row := m.Pix[y*m.Stride:]
 		for x := 0; x < width; x++ {
-			line.put(m.Pix[o])
-			o++
+			line.put(row[opts.column(x, width)])
 		}
 		if odd != 0 {
-			line.put(0)
+			line.pad()
 		}
 		if _, err := w.Write(line.flush()); err != nil {
 			return err
 		}
+		opts.progress(y+1, height)
 	}
-	return writeExtendedPalette(w, m.Palette)
+	if pal != nil {
+		return writeExtendedPalette(w, pal)
+	}
+	return nil
 }
 
-func encodePalettedImage(w io.Writer, m image.PalettedImage, p color.Palette) error {
+func encodePaletted(w io.Writer, m *image.Paletted, opts *EncodeOptions) error {
 	b := m.Bounds()
 	odd := b.Dx() & 1
 	bytesPerLine := b.Dx() + odd
-	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil); err != nil {
+	pal, remap := opts.palette(m.Palette)
+	gray := opts.ImplicitGrayRamp && isGrayRamp(pal)
+	info := paletteInfoColor
+	if gray {
+		info = paletteInfoGray
+	}
+	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil, info, opts); err != nil {
 		return err
 	}
-	line := &rleBuffer{b: make([]byte, b.Dx())}
+	if !gray || opts.GrayPalette {
+		if err := opts.leadingPalette(w, pal); err != nil {
+			return err
+		}
+	}
+	width := b.Dx()
+	height := b.Dy()
+	line := opts.newLine(width)
+	for y := 0; y < height; y++ {
+		line.reset()
+		row := m.Pix[y*m.Stride:]
+		for x := 0; x < width; x++ {
+			line.put(remap[row[opts.column(x, width)]])
+		}
+		if odd != 0 {
+			line.pad()
+		}
+		if _, err := w.Write(line.flush()); err != nil {
+			return err
+		}
+		opts.progress(y+1, height)
+	}
+	if gray && !opts.GrayPalette {
+		return nil
+	}
+	return writeExtendedPalette(w, pal)
+}
+
+// isGrayRamp reports whether p is the 256 level gray ramp that grayscale
+// files imply, with entry i being the opaque gray of level i.
+func isGrayRamp(p color.Palette) bool {
+	if len(p) != 256 {
+		return false
+	}
+	for i, c := range p {
+		r, g, b, a := c.RGBA()
+		v := uint32(i) * 0x101
+		if r != v || g != v || b != v || a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
+
+func encodePalettedImage(w io.Writer, m image.PalettedImage, p color.Palette, opts *EncodeOptions) error {
+	b := m.Bounds()
+	odd := b.Dx() & 1
+	bytesPerLine := b.Dx() + odd
+	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil, paletteInfoColor, opts); err != nil {
+		return err
+	}
+	pal, remap := opts.palette(p)
+	if err := opts.leadingPalette(w, pal); err != nil {
+		return err
+	}
+	line := opts.newLine(b.Dx())
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		line.reset()
-		for x := b.Min.X; x < b.Max.X; x++ {
-			line.put(m.ColorIndexAt(x, y))
+		for i := 0; i < b.Dx(); i++ {
+			line.put(remap[m.ColorIndexAt(b.Min.X+opts.column(i, b.Dx()), y)])
 		}
 		if odd != 0 {
-			line.put(0)
+			line.pad()
 		}
 		if _, err := w.Write(line.flush()); err != nil {
 			return err
 		}
+		opts.progress(y-b.Min.Y+1, b.Dy())
 	}
-	return writeExtendedPalette(w, p)
+	return writeExtendedPalette(w, pal)
 }
 
-func writeHeader(w io.Writer, bpp, nplanes, bytesPerLine int, bounds image.Rectangle, egaPalette color.Palette) error {
+// encodeHeaderPaletted writes m with 4 bits per pixel and its palette pal of
+// at most 16 colors in the header colormap, with no extended palette.
+func encodeHeaderPaletted(w io.Writer, m image.PalettedImage, pal color.Palette, remap *[256]uint8, opts *EncodeOptions) error {
+	b := m.Bounds()
+	n := (b.Dx() + 1) / 2
+	bytesPerLine := n + n&1
+	if err := writeHeader(w, 4, 1, bytesPerLine, b, pal, paletteInfoColor, opts); err != nil {
+		return err
+	}
+	line := opts.newLine(bytesPerLine)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		line.reset()
+		for i := 0; i < n; i++ {
+			v := remap[m.ColorIndexAt(b.Min.X+opts.column(2*i, b.Dx()), y)] << 4
+			if 2*i+1 < b.Dx() {
+				v |= remap[m.ColorIndexAt(b.Min.X+opts.column(2*i+1, b.Dx()), y)] & 0x0f
+			}
+			line.put(v)
+		}
+		if n&1 != 0 {
+			line.pad()
+		}
+		if _, err := w.Write(line.flush()); err != nil {
+			return err
+		}
+		opts.progress(y-b.Min.Y+1, b.Dy())
+	}
+	return nil
+}
+
+// EncodeLegacy writes m to w as a 16 color EGA image in the layout of PC
+// Paintbrush 2.5: version 0, four 1-bit planes and the palette stored in the
+// header, with no extended palette. The palette of m may have at most 16
+// colors.
+func EncodeLegacy(w io.Writer, m image.PalettedImage) error {
+	p, ok := m.ColorModel().(color.Palette)
+	if !ok || len(p) > 16 {
+		return errors.New("pcx: legacy encoding requires a palette of at most 16 colors")
+	}
+	opts := &EncodeOptions{}
+	b := m.Bounds()
+	bytesPerLine := (b.Dx() + 7) / 8
+	bytesPerLine += bytesPerLine & 1
+	if err := checkHeader(bytesPerLine, b); err != nil {
+		return err
+	}
+	hdr := encodeHeader(1, 4, bytesPerLine, b, p, paletteInfoColor, opts)
+	hdr[1] = 0 // version 2.5
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	planes := make([]byte, 4*bytesPerLine)
+	line := opts.newLine(bytesPerLine)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := range planes {
+			planes[i] = 0
+		}
+		for x := 0; x < b.Dx(); x++ {
+			idx := m.ColorIndexAt(b.Min.X+x, y)
+			if int(idx) >= len(p) {
+				return errors.New("pcx: color index out of palette range")
+			}
+			for i := 0; i < 4; i++ {
+				planes[i*bytesPerLine+x/8] |= (idx >> uint(i) & 1) << uint(7-x&7)
+			}
+		}
+		for i := 0; i < 4; i++ {
+			line.reset()
+			for _, v := range planes[i*bytesPerLine : (i+1)*bytesPerLine] {
+				line.put(v)
+			}
+			if _, err := w.Write(line.flush()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EncodeSolid writes a width x height PCX image of the single color c to w.
+// The image is stored as 8bpp with a one-entry palette so every scanline
+// compresses to a handful of maximal runs.
+func EncodeSolid(w io.Writer, c color.Color, width, height int) error {
+	if width <= 0 || height <= 0 {
+		return errors.New("pcx: invalid dimensions for solid image")
+	}
+	b := image.Rect(0, 0, width, height)
+	bytesPerLine := width + width&1
+	if err := writeHeader(w, 8, 1, bytesPerLine, b, nil, paletteInfoColor, &EncodeOptions{}); err != nil {
+		return err
+	}
+	line := &rleBuffer{b: make([]byte, 0, 2*(bytesPerLine/63+1))}
+	for x := 0; x < bytesPerLine; x++ {
+		line.put(0)
+	}
+	row := line.flush()
+	for y := 0; y < height; y++ {
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return writeExtendedPalette(w, color.Palette{c})
+}
+
+func writeHeader(w io.Writer, bpp, nplanes, bytesPerLine int, bounds image.Rectangle, egaPalette color.Palette, paletteInfo int, opts *EncodeOptions) error {
+	if err := checkHeader(bytesPerLine, bounds); err != nil {
+		return err
+	}
+	_, err := w.Write(encodeHeader(bpp, nplanes, bytesPerLine, bounds, egaPalette, paletteInfo, opts))
+	return err
+}
+
+// maxDimension is the largest value of the 16-bit header fields.
+const maxDimension = 0xffff
+
+// checkHeader reports an error if bounds are empty or bounds or bytesPerLine
+// do not fit the 16-bit header fields, which would otherwise be silently
+// truncated.
+func checkHeader(bytesPerLine int, bounds image.Rectangle) error {
+	if bounds.Empty() {
+		// The header stores an inclusive maximum, which cannot be less
+		// than the minimum.
+		return fmt.Errorf("pcx: cannot encode empty image bounds %v", bounds)
+	}
+	if bounds.Dx() > maxDimension || bounds.Dy() > maxDimension {
+		return fmt.Errorf("pcx: image size %dx%d exceeds the %d pixel limit", bounds.Dx(), bounds.Dy(), maxDimension)
+	}
+	if bounds.Min.X < math.MinInt16 || bounds.Min.Y < math.MinInt16 || bounds.Max.X-1 > maxDimension || bounds.Max.Y-1 > maxDimension {
+		return fmt.Errorf("pcx: image bounds %v do not fit the header", bounds)
+	}
+	// A negative minimum is only read back as such, by reading past the
+	// maximum when unsigned, along with a maximum from 0 to math.MaxInt16.
+	if bounds.Min.X < 0 && (bounds.Max.X-1 < 0 || bounds.Max.X-1 > math.MaxInt16) ||
+		bounds.Min.Y < 0 && (bounds.Max.Y-1 < 0 || bounds.Max.Y-1 > math.MaxInt16) {
+		return fmt.Errorf("pcx: image bounds %v do not fit the header", bounds)
+	}
+	if bytesPerLine > maxDimension {
+		return fmt.Errorf("pcx: image width %d needs too many bytes per line", bounds.Dx())
+	}
+	return nil
+}
+
+func encodeHeader(bpp, nplanes, bytesPerLine int, bounds image.Rectangle, egaPalette color.Palette, paletteInfo int, opts *EncodeOptions) []byte {
 	buf := make([]byte, 128)
+	putHeader(buf, bpp, nplanes, bytesPerLine, bounds, egaPalette, paletteInfo, opts)
+	return buf
+}
+
+// putHeader stores the header in the first 128 bytes of buf.
+func putHeader(buf []byte, bpp, nplanes, bytesPerLine int, bounds image.Rectangle, egaPalette color.Palette, paletteInfo int, opts *EncodeOptions) {
+	buf = buf[:128]
+	for i := range buf {
+		buf[i] = 0
+	}
 	buf[0] = magic
 	buf[1] = 5 // version
-	buf[2] = 1 // RLE
+	if opts.Version != 0 {
+		buf[1] = byte(opts.Version)
+	}
+	if opts.Compression != CompressionNone {
+		buf[2] = 1 // RLE
+	}
 	buf[3] = byte(bpp)
 	buf[4] = byte(bounds.Min.X & 0xff)
 	buf[5] = byte(bounds.Min.X >> 8)
@@ -165,6 +1022,11 @@ func writeHeader(w io.Writer, bpp, nplanes, bytesPerLine int, bounds image.Recta
 	buf[9] = byte((bounds.Max.X - 1) >> 8)
 	buf[10] = byte((bounds.Max.Y - 1) & 0xff)
 	buf[11] = byte((bounds.Max.Y - 1) >> 8)
+	hdpi, vdpi := opts.dpi()
+	buf[12] = byte(hdpi & 0xff)
+	buf[13] = byte(hdpi >> 8)
+	buf[14] = byte(vdpi & 0xff)
+	buf[15] = byte(vdpi >> 8)
 	if len(egaPalette) > 16 {
 		egaPalette = egaPalette[:16]
 	}
@@ -174,57 +1036,140 @@ func writeHeader(w io.Writer, bpp, nplanes, bytesPerLine int, bounds image.Recta
 		buf[16+1+i*3] = byte(g >> 8)
 		buf[16+2+i*3] = byte(b >> 8)
 	}
+	buf[64] = opts.Reserved
 	buf[65] = byte(nplanes)
 	buf[66] = byte(bytesPerLine & 0xff)
 	buf[67] = byte(bytesPerLine >> 8)
-	buf[68] = 1 // Color/BW
-	_, err := w.Write(buf)
-	return err
+	buf[68] = byte(paletteInfo)
 }
 
+// leadingPalette writes a copy of the extended palette pal directly after the
+// header if LeadingPalette is set.
+func (o *EncodeOptions) leadingPalette(w io.Writer, pal color.Palette) error {
+	if !o.LeadingPalette {
+		return nil
+	}
+	return writeExtendedPalette(w, pal)
+}
+
+// writeExtendedPalette writes the 256 color VGA palette following the pixel
+// data. Palettes with fewer colors are padded with black, so they decode
+// with 256 colors unless EncodeOptions.KeepPaletteLength records their
+// length.
 func writeExtendedPalette(w io.Writer, palette color.Palette) error {
 	buf := make([]byte, 3*256+1)
+	putExtendedPalette(buf, palette)
+	_, err := w.Write(buf)
+	return err
+}
+
+// putExtendedPalette stores the extended palette in the first 769 bytes of
+// buf.
+func putExtendedPalette(buf []byte, palette color.Palette) {
+	buf = buf[:3*256+1]
 	buf[0] = paletteMagic
+	if len(palette) > 256 {
+		palette = palette[:256]
+	}
 	for i, c := range palette {
 		r, g, b, _ := c.RGBA()
 		buf[1+i*3] = byte(r >> 8)
 		buf[2+i*3] = byte(g >> 8)
 		buf[3+i*3] = byte(b >> 8)
 	}
-	_, err := w.Write(buf)
-	return err
+	for i := 1 + 3*len(palette); i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// RLEStrategy run-length encodes scanlines for the encoder, in place of its
+// default greedy encoding. EncodeRow returns the encoding of row, one plane
+// of one scanline including any padding, in the standard PCX scheme: a byte
+// with its two high bits set repeats the following byte the number of times
+// in its low six bits, and any other byte is a literal. The result is
+// written before EncodeRow is called again.
+type RLEStrategy interface {
+	EncodeRow(row []byte) []byte
+}
+
+// GreedyRLE is the encoder's default RLEStrategy, which encodes every run of
+// equal bytes as a whole, up to the longest a run byte can hold.
+type GreedyRLE struct {
+	line rleBuffer
+}
+
+// EncodeRow implements RLEStrategy.
+func (g *GreedyRLE) EncodeRow(row []byte) []byte {
+	g.line.reset()
+	for _, b := range row {
+		g.line.put(b)
+	}
+	return g.line.flush()
 }
 
 type rleBuffer struct {
-	b []byte
-	n int
-	c byte
+	b         []byte
+	n         int
+	c         byte
+	raw       bool        // store bytes verbatim without run-length encoding
+	edge      bool        // pad with the last byte rather than 0
+	threshold byte        // smallest byte starting a run, 0xc0 if zero
+	strategy  RLEStrategy // encodes the buffered line on flush if set
+}
+
+// verbatim reports whether put stores bytes as given, either because the
+// line is uncompressed or because it is encoded by a strategy on flush.
+func (r *rleBuffer) verbatim() bool {
+	return r.raw || r.strategy != nil
 }
 
 func (r *rleBuffer) put(b byte) {
-	if r.n == 0 {
-		r.c = b
-		r.n = 1
-	} else if r.n != 0 {
-		if b == r.c && r.n != 63 {
+	if r.verbatim() {
+		r.b = append(r.b, b)
+		return
+	}
+	if r.n != 0 {
+		if b == r.c && r.n != int(^rleThreshold(r.threshold)) {
 			r.n++
 			return
 		}
-		if r.n != 1 || r.c >= 0xc0 {
-			r.b = append(r.b, 0xc0|byte(r.n))
-		}
-		r.b = append(r.b, r.c)
-		r.c = b
-		r.n = 1
+		r.emit()
+	}
+	r.c = b
+	r.n = 1
+}
+
+// emit appends the pending run. A single byte below the threshold is stored
+// as a literal, which is never larger than a run; runs are only broken at
+// their maximum length, 63 in standard files, so each maximal run of equal
+// bytes takes the fewest bytes possible.
+func (r *rleBuffer) emit() {
+	t := rleThreshold(r.threshold)
+	if r.n != 1 || r.c >= t {
+		r.b = append(r.b, t|byte(r.n))
+	}
+	r.b = append(r.b, r.c)
+}
+
+// pad appends the byte rounding a line of odd width up to an even length.
+func (r *rleBuffer) pad() {
+	var b byte
+	switch {
+	case !r.edge:
+	case r.verbatim() && len(r.b) > 0:
+		b = r.b[len(r.b)-1]
+	case !r.verbatim() && r.n != 0:
+		b = r.c
 	}
+	r.put(b)
 }
 
 func (r *rleBuffer) flush() []byte {
+	if r.strategy != nil && !r.raw {
+		return r.strategy.EncodeRow(r.b)
+	}
 	if r.n != 0 {
-		if r.n != 1 || r.c >= 0xc0 {
-			r.b = append(r.b, 0xc0|byte(r.n))
-		}
-		r.b = append(r.b, r.c)
+		r.emit()
 	}
 	r.n = 0
 	return r.b
@@ -233,3 +1178,54 @@ func (r *rleBuffer) flush() []byte {
 func (r *rleBuffer) reset() {
 	r.b = r.b[:0]
 }
+
+// NewRLEWriter returns a WriteCloser that run-length encodes everything
+// written to it and forwards the result to w. Runs never cross a boundary of
+// bytesPerLine bytes so each scanline (or plane of a scanline) is encoded
+// independently, as PCX requires. Close flushes a partial final line but does
+// not close w. If bytesPerLine is not positive, every Write and Close fails.
+func NewRLEWriter(w io.Writer, bytesPerLine int) io.WriteCloser {
+	r := &rleWriter{w: w, bytesPerLine: bytesPerLine, line: &rleBuffer{}}
+	if bytesPerLine <= 0 {
+		r.err = fmt.Errorf("pcx: invalid bytes per line %d", bytesPerLine)
+	}
+	return r
+}
+
+type rleWriter struct {
+	w            io.Writer
+	bytesPerLine int
+	line         *rleBuffer
+	n            int // bytes of the current line written so far
+	err          error
+}
+
+func (r *rleWriter) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for i, b := range p {
+		r.line.put(b)
+		r.n++
+		if r.n == r.bytesPerLine {
+			if r.err = r.flushLine(); r.err != nil {
+				return i + 1, r.err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (r *rleWriter) flushLine() error {
+	_, err := r.w.Write(r.line.flush())
+	r.line.reset()
+	r.n = 0
+	return err
+}
+
+func (r *rleWriter) Close() error {
+	if r.err == nil && r.n != 0 {
+		r.err = r.flushLine()
+	}
+	return r.err
+}
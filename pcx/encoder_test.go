@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"image/color"
+	"image/color/palette"
 	"image/png"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
@@ -53,3 +57,1162 @@ func TestEncoder(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeSolid(t *testing.T) {
+	c := color.RGBA{0x12, 0x34, 0x56, 0xff}
+	buf := &bytes.Buffer{}
+	if err := EncodeSolid(buf, c, 201, 3); err != nil {
+		t.Fatal(err)
+	}
+	// 202 bytes per line split into runs of 63, 63, 63 and 13.
+	if want := 128 + 3*8 + 769; buf.Len() != want {
+		t.Errorf("encoded size %d, want %d", buf.Len(), want)
+	}
+	img, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bounds()
+	if b.Dx() != 201 || b.Dy() != 3 {
+		t.Fatalf("decoded bounds %v", b)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if got := color.RGBAModel.Convert(img.At(x, y)); got != c {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, c)
+			}
+		}
+	}
+}
+
+func TestEncodeMirrorHorizontal(t *testing.T) {
+	b := image.Rect(0, 0, 5, 2)
+	rgba := image.NewRGBA(b)
+	nrgba := image.NewNRGBA(b)
+	pal := image.NewPaletted(b, color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.RGBA{uint8(x * 40), uint8(y * 90), 0x7f, 0xff}
+			rgba.Set(x, y, c)
+			nrgba.Set(x, y, c)
+			pal.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+	opts := &EncodeOptions{MirrorHorizontal: true}
+	for _, m := range []image.Image{rgba, nrgba, pal} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		mirrored, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if !sameColor(mirrored.At(x, y), m.At(b.Dx()-1-x, y)) {
+					t.Fatalf("%T: mirrored pixel (%d,%d) mismatch", m, x, y)
+				}
+			}
+		}
+		buf.Reset()
+		if err := EncodeWithOptions(buf, mirrored, opts); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if !sameColor(restored.At(x, y), m.At(x, y)) {
+					t.Fatalf("%T: restored pixel (%d,%d) mismatch", m, x, y)
+				}
+			}
+		}
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+func TestEncodeCompressionAuto(t *testing.T) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i)}
+	}
+	noisy := image.NewPaletted(image.Rect(0, 0, 9, 4), pal)
+	for i := range noisy.Pix {
+		noisy.Pix[i] = 0xc0 + uint8(i%7)
+	}
+	flat := image.NewPaletted(image.Rect(0, 0, 9, 4), pal)
+
+	for _, tc := range []struct {
+		m   *image.Paletted
+		rle byte
+	}{
+		{noisy, 0},
+		{flat, 1},
+	} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, tc.m, &EncodeOptions{Compression: CompressionAuto}); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes()[2]; got != tc.rle {
+			t.Errorf("RLE flag %d, want %d", got, tc.rle)
+		}
+		size, err := EncodedSize(tc.m, &EncodeOptions{Compression: CompressionAuto})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != buf.Len() {
+			t.Errorf("EncodedSize %d, encoded %d bytes", size, buf.Len())
+		}
+		img, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(img.(*image.Paletted).Pix, tc.m.Pix) {
+			t.Error("decoded pixels differ")
+		}
+	}
+}
+
+func TestRLEWriter(t *testing.T) {
+	lines := [][]byte{
+		bytes.Repeat([]byte{7}, 100),
+		append([]byte{1, 1, 0xc5}, bytes.Repeat([]byte{2}, 97)...),
+		append(bytes.Repeat([]byte{9}, 70), bytes.Repeat([]byte{3}, 30)...),
+	}
+	var data []byte
+	for _, l := range lines {
+		data = append(data, l...)
+	}
+	// A partial final line must be flushed by Close.
+	data = append(data, 5, 5, 5)
+
+	out := &bytes.Buffer{}
+	w := NewRLEWriter(out, 100)
+	for p := data; len(p) > 0; {
+		n := 37
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(rleLines(lines...), rleLines([]byte{5, 5, 5})...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("encoded %x, want %x", out.Bytes(), want)
+	}
+
+	for _, n := range []int{0, -1} {
+		w := NewRLEWriter(out, n)
+		if _, err := w.Write([]byte{1}); err == nil {
+			t.Errorf("bytesPerLine %d: expected Write error", n)
+		}
+		if err := w.Close(); err == nil {
+			t.Errorf("bytesPerLine %d: expected Close error", n)
+		}
+	}
+}
+
+func TestEncodePaletteKey(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	b := image.Rect(0, 0, 5, 3)
+	m1 := image.NewPaletted(b, color.Palette{color.White, red, color.Black, blue})
+	m2 := image.NewPaletted(b, color.Palette{blue, color.Black, red, color.White, red})
+	colors := []color.Color{color.White, red, color.Black, blue}
+	for i := range m1.Pix {
+		c := colors[i%len(colors)]
+		m1.Pix[i] = uint8(m1.Palette.Index(c))
+		m2.Pix[i] = uint8(m2.Palette.Index(c))
+	}
+	m2.Pix[1] = 4 // duplicate red entry
+
+	opts := &EncodeOptions{PaletteKey: Luminance}
+	var out [2][]byte
+	for i, m := range []*image.Paletted{m1, m2} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		img, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !sameColor(img.At(x, y), m.At(x, y)) {
+					t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, img.At(x, y), m.At(x, y))
+				}
+			}
+		}
+		out[i] = buf.Bytes()
+	}
+	if !bytes.Equal(out[0], out[1]) {
+		t.Error("encodings of the same logical image differ")
+	}
+}
+
+func TestEncodeDPI(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for _, tc := range []struct {
+		opts        *EncodeOptions
+		horiz, vert int
+	}{
+		{nil, DefaultDPI, DefaultDPI},
+		{&EncodeOptions{HorizDPI: 72}, 72, 72},
+		{&EncodeOptions{VertDPI: 600}, 600, 600},
+		{&EncodeOptions{HorizDPI: 200, VertDPI: 100}, 200, 100},
+	} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		_, meta, err := DecodeWithOptions(buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Header.HorizDPI != tc.horiz || meta.Header.VertDPI != tc.vert {
+			t.Errorf("%+v: decoded %dx%d DPI, want %dx%d", tc.opts, meta.Header.HorizDPI, meta.Header.VertDPI, tc.horiz, tc.vert)
+		}
+	}
+}
+
+func TestEncodePaletteInfo(t *testing.T) {
+	b := image.Rect(0, 0, 3, 3)
+	gray := image.NewGray(b)
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 20)
+	}
+	for _, tc := range []struct {
+		m    image.Image
+		info byte
+	}{
+		{image.NewRGBA(b), 1},
+		{image.NewNRGBA(b), 1},
+		{image.NewPaletted(b, color.Palette{color.Black}), 1},
+		{gray, 2},
+	} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, tc.m); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes()[68]; got != tc.info {
+			t.Errorf("%T: palette info %d, want %d", tc.m, got, tc.info)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, gray); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray); !ok || !bytes.Equal(g.Pix, gray.Pix) {
+		t.Error("grayscale image did not round-trip")
+	}
+}
+
+func TestEncodeRGBAWithMask(t *testing.T) {
+	rgb := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	mask := image.NewGray(image.Rect(10, 10, 15, 13))
+	for i := range rgb.Pix {
+		rgb.Pix[i] = uint8(i * 5)
+		if i%4 == 3 {
+			rgb.Pix[i] = 0xff
+		}
+	}
+	for i := range mask.Pix {
+		mask.Pix[i] = uint8(i * 16)
+	}
+	buf := &bytes.Buffer{}
+	if err := EncodeRGBAWithMask(buf, rgb, mask); err != nil {
+		t.Fatal(err)
+	}
+	if nplanes := buf.Bytes()[65]; nplanes != 4 {
+		t.Fatalf("wrote %d planes", nplanes)
+	}
+	img, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := img.(*image.RGBA)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			o := y*got.Stride + x*4
+			c := rgb.RGBAAt(x, y)
+			want := color.RGBAModel.Convert(color.NRGBA{c.R, c.G, c.B, mask.GrayAt(10+x, 10+y).Y}).(color.RGBA)
+			if c := (color.RGBA{got.Pix[o], got.Pix[o+1], got.Pix[o+2], got.Pix[o+3]}); c != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+
+	// The alpha of rgb is ignored rather than darkening its colors.
+	buf.Reset()
+	translucent := image.NewNRGBA(rgb.Rect)
+	for i := 0; i < len(translucent.Pix); i += 4 {
+		copy(translucent.Pix[i:], []byte{0xff, 0, 0, 0x80})
+	}
+	if err := EncodeRGBAWithMask(buf, translucent, mask); err != nil {
+		t.Fatal(err)
+	}
+	if img, err = Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.(*image.RGBA).RGBAAt(4, 2); c.R != c.A || c.G != 0 || c.B != 0 {
+		t.Errorf("translucent pixel written as %v, want full red", c)
+	}
+	if err := EncodeRGBAWithMask(&bytes.Buffer{}, rgb, image.NewGray(image.Rect(0, 0, 4, 3))); err == nil {
+		t.Error("expected error for mismatched mask size")
+	}
+}
+
+func TestEncodeLegacy(t *testing.T) {
+	pal := make(color.Palette, 16)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i * 16), uint8(255 - i*16), 0x55, 0xff}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 19, 3), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % 16)
+	}
+	buf := &bytes.Buffer{}
+	if err := EncodeLegacy(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if data[1] != 0 || data[3] != 1 || data[65] != 4 {
+		t.Fatalf("header version %d bpp %d planes %d", data[1], data[3], data[65])
+	}
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 19; x++ {
+			if !sameColor(img.At(x, y), m.At(x, y)) {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, img.At(x, y), m.At(x, y))
+			}
+		}
+	}
+
+	big := image.NewPaletted(image.Rect(0, 0, 1, 1), make(color.Palette, 17))
+	if err := EncodeLegacy(&bytes.Buffer{}, big); err == nil {
+		t.Error("expected error for 17 color palette")
+	}
+}
+
+func TestEncodeBackground(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	nrgba.SetNRGBA(0, 0, color.NRGBA{0, 0, 0xff, 0})
+	nrgba.SetNRGBA(1, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	rgba := image.NewRGBA(nrgba.Bounds())
+	rgba.Set(0, 0, nrgba.At(0, 0))
+	rgba.Set(1, 0, nrgba.At(1, 0))
+
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	for _, tc := range []struct {
+		name string
+		bg   color.Color
+		want color.Color
+	}{
+		{"default", nil, color.RGBA{0, 0, 0, 0xff}},
+		{"white", white, white},
+	} {
+		for _, m := range []image.Image{nrgba, rgba} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, m, &EncodeOptions{Background: tc.bg}); err != nil {
+				t.Fatal(err)
+			}
+			img, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := img.At(0, 0); !sameColor(c, tc.want) {
+				t.Errorf("%s %T: transparent pixel = %v, want %v", tc.name, m, c, tc.want)
+			}
+			if c := img.At(1, 0); !sameColor(c, color.RGBA{0xff, 0, 0, 0xff}) {
+				t.Errorf("%s %T: opaque pixel = %v", tc.name, m, c)
+			}
+		}
+	}
+}
+
+// rleBounds returns the smallest possible RLE encoding size of line, where each
+// maximal run of equal bytes is split into runs of at most 63, and the size of
+// storing every byte as a literal, escaping those of 0xc0 and above.
+func rleBounds(line []byte) (optimal, literal int) {
+	for i := 0; i < len(line); {
+		c, n := line[i], 1
+		for i+n < len(line) && line[i+n] == c {
+			n++
+		}
+		i += n
+		optimal += 2 * (n / 63)
+		switch rem := n % 63; {
+		case rem == 1 && c < 0xc0:
+			optimal++
+		case rem != 0:
+			optimal += 2
+		}
+		if c < 0xc0 {
+			literal += n
+		} else {
+			literal += 2 * n
+		}
+	}
+	return optimal, literal
+}
+
+func TestRLEMinimal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	lines := [][]byte{
+		{1, 2, 3},
+		{1, 1, 2, 2, 0xc0, 0xc1, 0xc1},
+		bytes.Repeat([]byte{4}, 64),
+		bytes.Repeat([]byte{0xff}, 127),
+	}
+	for i := 0; i < 100; i++ {
+		line := make([]byte, 1+rnd.Intn(300))
+		for j := range line {
+			// Few distinct values so runs of every length occur.
+			line[j] = []byte{0, 0xbf, 0xc0, 0xff}[rnd.Intn(4)]
+		}
+		lines = append(lines, line)
+	}
+	r := &rleBuffer{}
+	for _, line := range lines {
+		r.reset()
+		for _, b := range line {
+			r.put(b)
+		}
+		got := len(r.flush())
+		optimal, literal := rleBounds(line)
+		if got != optimal || got > literal {
+			t.Errorf("%x: encoded in %d bytes, optimal %d, literal %d", line, got, optimal, literal)
+		}
+	}
+}
+
+func BenchmarkRLE(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	line := make([]byte, 4096)
+	for i := range line {
+		line[i] = byte(rnd.Intn(4)) << 6
+	}
+	r := &rleBuffer{}
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		r.reset()
+		for _, c := range line {
+			r.put(c)
+		}
+		r.flush()
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for _, tc := range []struct {
+		opts     *EncodeOptions
+		version  byte
+		reserved byte
+	}{
+		{&EncodeOptions{}, 5, 0},
+		{&EncodeOptions{Version: 4, Reserved: 1}, 4, 1}, // Windows Paintbrush
+		{&EncodeOptions{Version: 5, Reserved: 0xff}, 5, 0xff},
+	} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if data[1] != tc.version || data[64] != tc.reserved {
+			t.Errorf("%+v: wrote version %d, reserved %d", tc.opts, data[1], data[64])
+		}
+		if _, err := Decode(buf); err != nil {
+			t.Errorf("%+v: %v", tc.opts, err)
+		}
+	}
+	if err := EncodeWithOptions(&bytes.Buffer{}, m, &EncodeOptions{Version: 1}); err == nil {
+		t.Error("expected error for version 1")
+	}
+}
+
+func TestEncodePadWithEdge(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	m := image.NewPaletted(image.Rect(0, 0, 5, 2), pal)
+	for i := range m.Pix {
+		m.Pix[i] = 1
+	}
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		var plain, edge bytes.Buffer
+		if err := EncodeWithOptions(&plain, m, &EncodeOptions{Compression: c}); err != nil {
+			t.Fatal(err)
+		}
+		if err := EncodeWithOptions(&edge, m, &EncodeOptions{Compression: c, PadWithEdge: true}); err != nil {
+			t.Fatal(err)
+		}
+		if c == CompressionNone {
+			if pad := edge.Bytes()[128+5]; pad != 1 {
+				t.Errorf("padding byte = %d, want 1", pad)
+			}
+		} else if edge.Len() >= plain.Len() {
+			t.Errorf("edge padded size %d, want less than %d", edge.Len(), plain.Len())
+		}
+		img, err := Decode(&edge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 5; x++ {
+				if !sameColor(img.At(x, y), color.White) {
+					t.Errorf("pixel (%d, %d) = %v", x, y, img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeProgress(t *testing.T) {
+	b := image.Rect(2, 3, 6, 8)
+	for _, m := range []image.Image{
+		image.NewRGBA(b),
+		image.NewPaletted(b, color.Palette{color.Black}),
+		image.NewGray(b),
+		image.NewNRGBA(b),
+	} {
+		for _, c := range []Compression{CompressionRLE, CompressionAuto} {
+			var calls []int
+			opts := &EncodeOptions{
+				Compression: c,
+				Progress: func(done, total int) {
+					if total != b.Dy() {
+						t.Errorf("%T: total %d, want %d", m, total, b.Dy())
+					}
+					calls = append(calls, done)
+				},
+			}
+			if err := EncodeWithOptions(&bytes.Buffer{}, m, opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(calls) != b.Dy() {
+				t.Fatalf("%T: %d progress calls, want %d", m, len(calls), b.Dy())
+			}
+			for i, done := range calls {
+				if done != i+1 {
+					t.Errorf("%T: call %d reported %d rows", m, i, done)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	b := image.Rect(0, 0, 13, 7)
+	rgba := image.NewNRGBA(b)
+	rnd.Read(rgba.Pix)
+	// A palette with duplicate entries exercises the PaletteKey sort.
+	pal := make(color.Palette, 64)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i % 8 * 30), uint8(i % 8 * 10), 0, 0xff}
+	}
+	paletted := image.NewPaletted(b, pal)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rnd.Intn(len(pal)))
+	}
+
+	opts := &EncodeOptions{
+		PaletteKey: Luminance,
+		Background: color.White,
+		Properties: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5"},
+	}
+	// Quantizing again for every encoding also covers the median cut.
+	for _, img := range []func() image.Image{
+		func() image.Image { return rgba },
+		func() image.Image { return paletted },
+		func() image.Image { return quantize(rgba, 16) },
+	} {
+		var first []byte
+		for i := 0; i < 10; i++ {
+			m := img()
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, m, opts); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = buf.Bytes()
+			} else if !bytes.Equal(buf.Bytes(), first) {
+				t.Fatalf("%T: encoding %d differs from the first", m, i)
+			}
+		}
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	for _, m := range []image.Image{
+		image.NewGray(image.Rect(0, 0, 65536, 1)),
+		image.NewGray(image.Rect(0, 0, 1, 65536)),
+		image.NewGray(image.Rect(65535, 0, 65537, 1)),
+		image.NewGray(image.Rect(0, 0, 65535, 1)), // padded to 65536 bytes per line
+		image.NewGray(image.Rect(-10, 0, 40000, 1)),
+		image.NewGray(image.Rect(0, -1, 1, 32770)),
+		image.NewGray(image.Rect(-10, -10, -2, -4)),
+		image.NewGray(image.Rect(-5, 0, -4, 1)),
+		image.NewGray(image.Rect(0, 0, 0, 5)),
+		image.NewRGBA(image.Rect(3, 3, 8, 3)),
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); err == nil {
+			t.Errorf("%T %v: expected error", m, m.Bounds())
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%T %v: wrote %d bytes", m, m.Bounds(), buf.Len())
+		}
+	}
+	if err := Encode(io.Discard, image.NewGray(image.Rect(0, 0, 65534, 1))); err != nil {
+		t.Errorf("largest width: %v", err)
+	}
+	if err := Encode(io.Discard, image.NewGray(image.Rect(-10, 0, 32768, 1))); err != nil {
+		t.Errorf("largest maximum with a negative minimum: %v", err)
+	}
+	m := image.NewGray(image.Rect(-10, -3, 1, 2))
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatalf("smallest maximum with a negative minimum: %v", err)
+	}
+	img, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != m.Bounds() {
+		t.Errorf("decoded bounds %v, want %v", img.Bounds(), m.Bounds())
+	}
+}
+
+func TestEncodeWideRuns(t *testing.T) {
+	for _, width := range []int{63, 64, 127, 131, 201} {
+		for _, v := range []uint8{0, 5, 0xc7} {
+			pal := make(color.Palette, 256)
+			for i := range pal {
+				pal[i] = color.Gray{uint8(i)}
+			}
+			m := image.NewPaletted(image.Rect(0, 0, width, 3), pal)
+			for i := range m.Pix {
+				m.Pix[i] = v
+			}
+			var buf bytes.Buffer
+			if err := Encode(&buf, m); err != nil {
+				t.Fatal(err)
+			}
+			data := buf.Bytes()[128:]
+			bytesPerLine := width + width&1
+			// Every scanline must decode to exactly bytesPerLine bytes from
+			// runs of at most 63, so no run crosses into the next row.
+			for y := 0; y < 3; y++ {
+				var line []byte
+				for len(line) < bytesPerLine {
+					c := data[0]
+					data = data[1:]
+					n := 1
+					if c >= 0xc0 {
+						n = int(c & 0x3f)
+						c = data[0]
+						data = data[1:]
+					}
+					line = append(line, bytes.Repeat([]byte{c}, n)...)
+				}
+				want := bytes.Repeat([]byte{v}, width)
+				if width&1 != 0 {
+					want = append(want, 0)
+				}
+				if !bytes.Equal(line, want) {
+					t.Fatalf("width %d value %#x row %d: decoded %d bytes %x", width, v, y, len(line), line)
+				}
+			}
+			if len(data) == 0 || data[0] != paletteMagic {
+				t.Errorf("width %d value %#x: pixel data does not end after 3 rows", width, v)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := image.Rect(1, 2, 8, 5)
+	gray := image.NewGray(b)
+	rgba := image.NewRGBA(b)
+	paletted := image.NewPaletted(b, palette.WebSafe)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(gray.Pix)
+	rnd.Read(rgba.Pix)
+	for i := 3; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i] = 0xff
+	}
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rnd.Intn(len(palette.WebSafe)))
+	}
+	for _, m := range []image.Image{gray, rgba, paletted} {
+		got, err := RoundTrip(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds() != b {
+			t.Fatalf("%T: bounds %v, want %v", m, got.Bounds(), b)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !sameColor(got.At(x, y), m.At(x, y)) {
+					t.Fatalf("%T: pixel (%d,%d) = %v, want %v", m, x, y, got.At(x, y), m.At(x, y))
+				}
+			}
+		}
+	}
+
+	translucent := image.NewNRGBA(b)
+	translucent.Set(b.Min.X, b.Min.Y, color.NRGBA{0xff, 0, 0, 0x80})
+	got, err := RoundTrip(translucent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := got.At(b.Min.X, b.Min.Y); c != (color.RGBA{0x80, 0, 0, 0xff}) {
+		t.Errorf("translucent pixel = %v", c)
+	}
+}
+
+func TestIsLossless(t *testing.T) {
+	b := image.Rect(0, 0, 3, 2)
+	translucent := image.NewRGBA(b)
+	opaque := image.NewRGBA(b)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+	for _, tc := range []struct {
+		m    image.Image
+		want bool
+	}{
+		{image.NewGray(b), true},
+		{opaque, true},
+		{translucent, false},
+		{image.NewPaletted(b, palette.Plan9), true},
+		{image.NewPaletted(b, color.Palette{color.Black, color.Transparent}), false},
+		{image.NewPaletted(b, color.Palette{color.Gray16{0x1234}}), false},
+		{image.NewNRGBA(b), false},
+		{image.NewYCbCr(b, image.YCbCrSubsampleRatio444), false},
+		{image.NewGray16(b), false},
+	} {
+		if got := IsLossless(tc.m); got != tc.want {
+			t.Errorf("IsLossless(%T) = %t, want %t", tc.m, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeHeaderPalette(t *testing.T) {
+	pal := color.Palette{color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0xff, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}}
+	m := image.NewPaletted(image.Rect(0, 0, 5, 2), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % 3)
+	}
+	for _, mirror := range []bool{false, true} {
+		var buf bytes.Buffer
+		opts := &EncodeOptions{HeaderPalette: true, KeepPaletteLength: true, MirrorHorizontal: mirror}
+		if err := EncodeWithOptions(&buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		img, meta, err := DecodeWithOptions(&buf, &DecodeOptions{Trailer: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Header.BitsPerPixel != 4 || meta.Header.Planes != 1 {
+			t.Errorf("wrote %d bpp %d planes, want 4 bpp 1 plane", meta.Header.BitsPerPixel, meta.Header.Planes)
+		}
+		p := img.(*image.Paletted)
+		if len(p.Palette) != 3 {
+			t.Errorf("decoded %d colors, want 3", len(p.Palette))
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 5; x++ {
+				sx := x
+				if mirror {
+					sx = 4 - x
+				}
+				if !sameColor(p.At(x, y), m.At(sx, y)) {
+					t.Errorf("mirror %v: pixel (%d,%d) = %v, want %v", mirror, x, y, p.At(x, y), m.At(sx, y))
+				}
+			}
+		}
+	}
+
+	// Images with more than 16 colors keep the extended palette.
+	big := image.NewPaletted(image.Rect(0, 0, 2, 2), palette.Plan9)
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, big, &EncodeOptions{HeaderPalette: true}); err != nil {
+		t.Fatal(err)
+	}
+	if bpp := buf.Bytes()[3]; bpp != 8 {
+		t.Errorf("256 color image written with %d bpp", bpp)
+	}
+}
+
+// tiledRGBA and tiledNRGBA stand in for custom image types that provide
+// direct pixel access.
+type tiledRGBA struct{ *image.RGBA }
+type tiledNRGBA struct{ *image.NRGBA }
+
+func TestEncodePixelAccessors(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	b := image.Rect(2, 1, 9, 6)
+	rgba := image.NewRGBA(b)
+	nrgba := image.NewNRGBA(b)
+	rnd.Read(nrgba.Pix)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			rgba.Set(x, y, nrgba.At(x, y))
+		}
+	}
+	opts := &EncodeOptions{Background: color.RGBA{0x10, 0x20, 0x30, 0xff}}
+	for _, tc := range []struct {
+		fast image.Image
+		ref  image.Image
+	}{
+		{tiledRGBA{rgba}, rgba},
+		{tiledNRGBA{nrgba}, struct{ image.Image }{nrgba}},
+	} {
+		var got, want bytes.Buffer
+		if err := EncodeWithOptions(&got, tc.fast, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := EncodeWithOptions(&want, tc.ref, opts); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("%T: encoding differs from %T", tc.fast, tc.ref)
+		}
+	}
+}
+
+func TestEncodeRLEThresholdRuns(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 300, 1))
+	for i := range m.Pix {
+		m.Pix[i] = 0x90
+	}
+	for _, threshold := range []byte{0x80, 0xc0, 0xe0, 0xf0} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, m, &EncodeOptions{RLEThreshold: threshold}); err != nil {
+			t.Fatal(err)
+		}
+		// The row splits into runs of the longest length the threshold allows.
+		max := int(^threshold)
+		var want []byte
+		for n := 300; n > 0; n -= max {
+			run := max
+			if n < max {
+				run = n
+			}
+			want = append(want, threshold|byte(run), 0x90)
+		}
+		if got := buf.Bytes()[128:]; !bytes.Equal(got, want) {
+			t.Errorf("threshold %#x: encoded %x, want %x", threshold, got, want)
+		}
+		img, _, err := DecodeWithOptions(&buf, &DecodeOptions{RLEThreshold: threshold})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(img.(*image.Gray).Pix, m.Pix) {
+			t.Errorf("threshold %#x: round trip changed the pixels", threshold)
+		}
+	}
+}
+
+func TestEncodeGrayPalette(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 40)
+	}
+	props := map[string]string{"k": "v"}
+	var plain, ramp bytes.Buffer
+	if err := EncodeWithOptions(&plain, m, &EncodeOptions{Properties: props}); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeWithOptions(&ramp, m, &EncodeOptions{Properties: props, GrayPalette: true}); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Len()+1+3*256 != ramp.Len() {
+		t.Fatalf("gray palette added %d bytes, want 769", ramp.Len()-plain.Len())
+	}
+	data := ramp.Bytes()
+
+	img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray); !ok || !bytes.Equal(g.Pix, m.Pix) {
+		t.Errorf("decoded %T %v, want gray %v", img, img, m.Pix)
+	}
+	if meta.Properties["k"] != "v" {
+		t.Errorf("properties after the gray palette = %v", meta.Properties)
+	}
+
+	// Viewers that read the palette see the same gray levels.
+	img, _, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{PreferPalette: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(2, 1); !sameColor(c, m.At(2, 1)) {
+		t.Errorf("paletted pixel = %v, want %v", c, m.At(2, 1))
+	}
+}
+
+func TestEncodeImplicitGrayRamp(t *testing.T) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i)}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), pal)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 50)
+	}
+	var plain, ramp bytes.Buffer
+	if err := Encode(&plain, m); err != nil {
+		t.Fatal(err)
+	}
+	opts := &EncodeOptions{ImplicitGrayRamp: true}
+	if err := EncodeWithOptions(&ramp, m, opts); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Len()-ramp.Len() != 1+3*256 {
+		t.Fatalf("implicit ramp saved %d bytes, want 769", plain.Len()-ramp.Len())
+	}
+	img, err := Decode(&ramp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := img.(*image.Gray); !ok || !bytes.Equal(g.Pix, m.Pix) {
+		t.Errorf("decoded %T %v, want gray %v", img, img, m.Pix)
+	}
+
+	// Any other palette keeps the extended palette.
+	m.Palette[7] = color.Gray{8}
+	ramp.Reset()
+	if err := EncodeWithOptions(&ramp, m, opts); err != nil {
+		t.Fatal(err)
+	}
+	if ramp.Len() != plain.Len() {
+		t.Errorf("non-ramp palette encoded in %d bytes, want %d", ramp.Len(), plain.Len())
+	}
+}
+
+func TestEncodePaletteAlpha(t *testing.T) {
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	half := color.NRGBA{0, 0xff, 0, 0x80}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.NRGBA{}, red, half})
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % 3)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, m, &EncodeOptions{PaletteAlpha: true}); err != nil {
+		t.Fatal(err)
+	}
+	if planes := buf.Bytes()[65]; planes != 4 {
+		t.Fatalf("wrote %d planes, want 4", planes)
+	}
+	img, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			if got, want := img.At(x, y), m.At(x, y); !sameColor(got, want) {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Opaque palettes are still written paletted.
+	buf.Reset()
+	m.Palette[0] = color.Black
+	m.Palette[2] = red
+	if err := EncodeWithOptions(&buf, m, &EncodeOptions{PaletteAlpha: true}); err != nil {
+		t.Fatal(err)
+	}
+	if planes := buf.Bytes()[65]; planes != 1 {
+		t.Errorf("opaque palette written with %d planes, want 1", planes)
+	}
+}
+
+func TestEncodeLeadingPalette(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), palette.Plan9)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 40)
+	}
+	const palSize = 1 + 3*256
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		var buf bytes.Buffer
+		opts := &EncodeOptions{Compression: c, LeadingPalette: true, Properties: map[string]string{"k": "v"}}
+		if err := EncodeWithOptions(&buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if c == CompressionNone && !bytes.Equal(data[128:128+palSize], data[128+palSize+4*2:][:palSize]) {
+			t.Error("leading palette is not a copy of the trailing one")
+		}
+
+		img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Trailer: true, LeadingPalette: true})
+		if err != nil {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+		if p, ok := img.(*image.Paletted); !ok || !bytes.Equal(p.Pix, m.Pix) || !sameColor(p.Palette[40], m.Palette[40]) {
+			t.Errorf("compression %d: decoded %T differs from the encoded image", c, img)
+		}
+		if meta.Properties["k"] != "v" {
+			t.Errorf("compression %d: properties = %v", c, meta.Properties)
+		}
+		img, _, err = DecodeWithOptions(struct{ io.Reader }{bytes.NewReader(data)}, &DecodeOptions{LeadingPalette: true})
+		if err != nil {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+		if !sameColor(img.At(2, 1), m.At(2, 1)) {
+			t.Errorf("compression %d: pixel = %v, want %v", c, img.At(2, 1), m.At(2, 1))
+		}
+	}
+
+	// Grayscale images only get a leading palette along with GrayPalette.
+	g := image.NewGray(m.Bounds())
+	for i := range g.Pix {
+		g.Pix[i] = uint8(i * 30)
+	}
+	for _, gp := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, g, &EncodeOptions{LeadingPalette: true, GrayPalette: gp}); err != nil {
+			t.Fatal(err)
+		}
+		if leading := buf.Bytes()[128] == paletteMagic; leading != gp {
+			t.Errorf("GrayPalette %t: leading palette written %t", gp, leading)
+		}
+		img, _, err := DecodeWithOptions(&buf, &DecodeOptions{LeadingPalette: gp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := img.(*image.Gray); !ok || !bytes.Equal(got.Pix, g.Pix) {
+			t.Errorf("GrayPalette %t: decoded %T %v, want %v", gp, img, img, g.Pix)
+		}
+	}
+}
+
+// escapeAll is an RLEStrategy that stores every byte as a run of one.
+type escapeAll struct {
+	out []byte
+}
+
+func (e *escapeAll) EncodeRow(row []byte) []byte {
+	e.out = e.out[:0]
+	for _, b := range row {
+		e.out = append(e.out, 0xc1, b)
+	}
+	return e.out
+}
+
+func TestEncodeRLEStrategy(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 8 * 0x31)
+		if i%4 == 3 {
+			m.Pix[i] = 0xff
+		}
+	}
+	var def, greedy, escaped bytes.Buffer
+	if err := Encode(&def, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeWithOptions(&greedy, m, &EncodeOptions{RLEStrategy: &GreedyRLE{}}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(greedy.Bytes(), def.Bytes()) {
+		t.Error("GreedyRLE output differs from the default encoding")
+	}
+	if err := EncodeWithOptions(&escaped, m, &EncodeOptions{RLEStrategy: &escapeAll{}}); err != nil {
+		t.Fatal(err)
+	}
+	// Each of the 3 rows has 3 planes of 6 bytes, including padding.
+	if want := 128 + 3*3*6*2; escaped.Len() != want {
+		t.Errorf("escaped encoding is %d bytes, want %d", escaped.Len(), want)
+	}
+	img, err := Decode(&escaped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			if !sameColor(img.At(x, y), m.At(x, y)) {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, img.At(x, y), m.At(x, y))
+			}
+		}
+	}
+
+	opts := &EncodeOptions{RLEStrategy: &GreedyRLE{}, RLEThreshold: 0x80}
+	if err := EncodeWithOptions(&bytes.Buffer{}, m, opts); err == nil {
+		t.Error("expected error combining RLEStrategy and RLEThreshold")
+	}
+}
+
+func TestEncodeToBuffer(t *testing.T) {
+	paletted := image.NewPaletted(image.Rect(2, 1, 11, 6), palette.Plan9[:20])
+	gray := image.NewGray(image.Rect(0, 0, 9, 5))
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i / 4 % 20)
+		gray.Pix[i] = uint8(i / 3 * 40)
+	}
+	for _, m := range []image.Image{testRGBA(9, 5), paletted, gray} {
+		var want bytes.Buffer
+		if err := Encode(&want, m); err != nil {
+			t.Fatal(err)
+		}
+		size, err := EncodedSize(m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A recycled buffer holds the previous contents.
+		dst := bytes.Repeat([]byte{0xff}, size+10)
+		n, err := EncodeToBuffer(dst, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size || !bytes.Equal(dst[:n], want.Bytes()) {
+			t.Errorf("%T: wrote %d bytes, want %d matching Encode", m, n, size)
+		}
+		for _, short := range []int{size - 1, size - 3*256, 130, 10} {
+			if short < 0 {
+				continue
+			}
+			if _, err := EncodeToBuffer(dst[:short], m); err != io.ErrShortBuffer {
+				t.Errorf("%T: %d byte buffer: got %v, want io.ErrShortBuffer", m, short, err)
+			}
+		}
+	}
+
+	dst := make([]byte, 4096)
+	for _, m := range []image.Image{paletted, gray} {
+		allocs := testing.AllocsPerRun(10, func() {
+			if _, err := EncodeToBuffer(dst, m); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%T: %v allocations per call", m, allocs)
+		}
+	}
+}
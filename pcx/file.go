@@ -0,0 +1,118 @@
+package pcx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isDCX reports whether path names a DCX file by its extension.
+func isDCX(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".dcx")
+}
+
+// Open decodes the image in the named file. Files with a .dcx extension are
+// decoded as DCX and only their first page is read and returned; all others
+// are decoded as PCX.
+func Open(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if isDCX(path) {
+		return decodeFirstDCXPage(f)
+	}
+	return Decode(f)
+}
+
+// Save writes m to the named file, creating or truncating it. Files with a
+// .dcx extension are written as a single page DCX file; all others are
+// written as PCX.
+func Save(path string, m image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if isDCX(path) {
+		err = EncodeDCX(bw, []image.Image{m})
+	} else {
+		err = Encode(bw, m)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DecodeFileWithPalette decodes the PCX image in the file imgPath using the
+// palette in the file palPath in place of its own extended palette. The
+// palette file may hold 768 bytes of raw 8-bit RGB triples, as many DOS games
+// store them, or be a JASC-PAL text palette. The palette only applies to 8bpp
+// paletted images; other images are decoded as usual.
+func DecodeFileWithPalette(imgPath, palPath string) (image.Image, error) {
+	data, err := os.ReadFile(palPath)
+	if err != nil {
+		return nil, err
+	}
+	pal, err := parsePaletteFile(data)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := DecodeWithOptions(f, &DecodeOptions{Palette: pal})
+	return m, err
+}
+
+// parsePaletteFile parses a raw 768 byte palette or a JASC-PAL text palette.
+// Palettes of fewer than 256 colors are padded with black so that every
+// index decodes.
+func parsePaletteFile(data []byte) (color.Palette, error) {
+	if len(data) == 3*256 && !bytes.HasPrefix(data, []byte("JASC-PAL")) {
+		pal := make(color.Palette, 256)
+		for i := range pal {
+			pal[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 0xff}
+		}
+		return pal, nil
+	}
+	f := strings.Fields(string(data))
+	if len(f) < 3 || f[0] != "JASC-PAL" {
+		return nil, errors.New("pcx: unrecognized palette file")
+	}
+	n, err := strconv.Atoi(f[2])
+	if err != nil || n < 1 || n > 256 || len(f) < 3+3*n {
+		return nil, errors.New("pcx: invalid JASC-PAL color count")
+	}
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		if i >= n {
+			pal[i] = color.RGBA{0, 0, 0, 0xff}
+			continue
+		}
+		var rgb [3]uint8
+		for j := range rgb {
+			v, err := strconv.ParseUint(f[3+3*i+j], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("pcx: invalid JASC-PAL color %d", i)
+			}
+			rgb[j] = uint8(v)
+		}
+		pal[i] = color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+	}
+	return pal, nil
+}
@@ -0,0 +1,102 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenSave(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 4, 3), color.Palette{color.Black, color.White})
+	m.SetColorIndex(2, 1, 1)
+	dir := t.TempDir()
+	for _, name := range []string{"a.pcx", "b.DCX"} {
+		path := filepath.Join(dir, name)
+		if err := Save(path, m); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Open(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got.Bounds() != m.Bounds() || !sameColor(got.At(2, 1), color.White) {
+			t.Errorf("%s: decoded image differs", name)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "b.DCX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(data) != dcxMagic {
+		t.Error("b.DCX not written as DCX")
+	}
+}
+
+func TestOpenDCXFirstPageOnly(t *testing.T) {
+	first := image.NewGray(image.Rect(0, 0, 2, 2))
+	second := image.NewGray(image.Rect(0, 0, 3, 3))
+	var buf bytes.Buffer
+	if err := EncodeDCX(&buf, []image.Image{first, second}); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the second page; Open must not read it.
+	data := buf.Bytes()
+	off := binary.LittleEndian.Uint32(data[8:])
+	data[off] = 0
+	path := filepath.Join(t.TempDir(), "pages.dcx")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != first.Bounds() {
+		t.Errorf("bounds = %v, want %v", got.Bounds(), first.Bounds())
+	}
+	if _, err := DecodeDCX(bytes.NewReader(data)); err == nil {
+		t.Error("DecodeDCX: expected error for the corrupt second page")
+	}
+}
+
+func TestDecodeFileWithPalette(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 3, 1), color.Palette{color.Black, color.White, color.Black})
+	m.Pix = []uint8{0, 1, 2}
+	dir := t.TempDir()
+	imgPath := filepath.Join(dir, "art.pcx")
+	if err := Save(imgPath, m); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := make([]byte, 3*256)
+	copy(raw, []byte{10, 20, 30, 40, 50, 60, 70, 80, 90})
+	jasc := "JASC-PAL\r\n0100\r\n3\r\n10 20 30\r\n40 50 60\r\n70 80 90\r\n"
+	for name, data := range map[string][]byte{"raw.pal": raw, "jasc.pal": []byte(jasc)} {
+		palPath := filepath.Join(dir, name)
+		if err := os.WriteFile(palPath, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeFileWithPalette(imgPath, palPath)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for x, want := range []color.RGBA{{10, 20, 30, 0xff}, {40, 50, 60, 0xff}, {70, 80, 90, 0xff}} {
+			if c := got.At(x, 0); !sameColor(c, want) {
+				t.Errorf("%s: pixel %d = %v, want %v", name, x, c, want)
+			}
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.pal")
+	if err := os.WriteFile(bad, []byte("JASC-PAL\n0100\n2\n1 2 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeFileWithPalette(imgPath, bad); err == nil {
+		t.Error("expected error for truncated JASC-PAL file")
+	}
+}
@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"testing"
+)
+
+// fuzzMaxPixels bounds the size of images decoded by FuzzDecode, keeping the
+// memory used by any single input small.
+const fuzzMaxPixels = 1 << 20
+
+func FuzzDecode(f *testing.F) {
+	b := image.Rect(0, 0, 7, 3)
+	rgba := image.NewRGBA(b)
+	gray := image.NewGray(b)
+	paletted := image.NewPaletted(b, palette.Plan9)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 37)
+	}
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 11)
+		paletted.Pix[i] = uint8(i * 13)
+	}
+	for _, m := range []image.Image{rgba, gray, paletted} {
+		for _, c := range []Compression{CompressionRLE, CompressionNone} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, m, &EncodeOptions{Compression: c}); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	var buf bytes.Buffer
+	if err := EncodeLegacy(&buf, image.NewPaletted(b, color.Palette{color.Black, color.White})); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	// Single-plane 5bpp files once indexed past the header palette.
+	f.Add(append(makeHeader(5, 5, 1, 6, image.Rect(0, 0, 8, 1)), 0xc6, 0xff))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if cfg.Width*cfg.Height > fuzzMaxPixels {
+			return
+		}
+		for _, opts := range []*DecodeOptions{nil, {Strict: true, Trailer: true}} {
+			m, _, err := DecodeWithOptions(bytes.NewReader(data), opts)
+			if err != nil {
+				continue
+			}
+			if got := m.Bounds().Size(); got != image.Pt(cfg.Width, cfg.Height) {
+				t.Errorf("decoded size %v, config %dx%d", got, cfg.Width, cfg.Height)
+			}
+			// Every pixel must be readable, including indices past the
+			// end of a short palette.
+			mb := m.Bounds()
+			for y := mb.Min.Y; y < mb.Max.Y; y++ {
+				for x := mb.Min.X; x < mb.Max.X; x++ {
+					m.At(x, y)
+				}
+			}
+		}
+	})
+}
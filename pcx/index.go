@@ -0,0 +1,98 @@
+package pcx
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ScanlineOffsets reads a complete PCX image from r without decoding its
+// pixels and returns the byte offset, relative to the start of the file, at
+// which the RLE data of every scanline begins. The returned slice has one
+// more entry than the image has rows; the last entry is the offset just past
+// the pixel data, where the extended palette of 8bpp images starts.
+//
+// The offsets let DecodeRows decode an arbitrary range of rows without
+// decoding the rows before it.
+func ScanlineOffsets(r io.Reader) ([]int64, error) {
+	cr := &countingReader{r: r}
+	d, err := newDecoder(cr)
+	if err != nil {
+		return nil, err
+	}
+	bufR := bufio.NewReader(cr)
+	height := d.bounds.Dy()
+	offsets := make([]int64, height+1)
+	for y := 0; y < height; y++ {
+		offsets[y] = cr.n - int64(bufR.Buffered())
+		if err := d.decodeScanline(bufR, nil); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	offsets[height] = cr.n - int64(bufR.Buffered())
+	return offsets, nil
+}
+
+// DecodeRows decodes rows y0 (inclusive) through y1 (exclusive), counted from
+// the top of the image, of the PCX image in r using the offsets returned by
+// ScanlineOffsets. The returned image covers only the decoded rows and keeps
+// their position within the bounds of the full image.
+func DecodeRows(r io.ReaderAt, offsets []int64, y0, y1 int) (image.Image, error) {
+	d, err := newDecoder(io.NewSectionReader(r, 0, 128))
+	if err != nil {
+		return nil, err
+	}
+	height := d.bounds.Dy()
+	if len(offsets) != height+1 {
+		return nil, fmt.Errorf("pcx: scanline offsets do not match image height %d", height)
+	}
+	if y0 < 0 || y1 > height || y0 >= y1 {
+		return nil, fmt.Errorf("pcx: invalid row range [%d, %d)", y0, y1)
+	}
+	if d.hasExtendedPalette() {
+		d.palette = make(color.Palette, 256)
+		palR := bufio.NewReader(io.NewSectionReader(r, offsets[height], maxPaletteSkip+1+3*256))
+		if err := d.readExtendedPalette(palR, d.palette); err != nil {
+			return nil, err
+		}
+	}
+	d.bounds.Min.Y, d.bounds.Max.Y = d.bounds.Min.Y+y0, d.bounds.Min.Y+y1
+	d.r = io.NewSectionReader(r, offsets[y0], offsets[y1]-offsets[y0])
+	return d.decode()
+}
+
+// DecodePreview decodes only the first maxRows rows of the PCX image in r, or
+// the whole image if it has fewer, and stops reading the pixel data there.
+// Images with an extended palette, which follows the pixel data, have their
+// remaining scanlines read past without being stored.
+func DecodePreview(r io.Reader, maxRows int) (image.Image, error) {
+	if maxRows < 1 {
+		return nil, fmt.Errorf("pcx: invalid preview row count %d", maxRows)
+	}
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	if h := d.bounds.Dy(); maxRows < h {
+		d.skipRows = h - maxRows
+		d.bounds.Max.Y = d.bounds.Min.Y + maxRows
+	}
+	return d.decode()
+}
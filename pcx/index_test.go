@@ -0,0 +1,109 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeRows(t *testing.T) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i), uint8(255 - i), 0x10, 0xff}
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 7, 9), pal)
+	rgba := image.NewRGBA(image.Rect(0, 0, 7, 9))
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 7)
+	}
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 3)
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xff
+		}
+	}
+
+	for _, m := range []image.Image{paletted, rgba} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		offsets, err := ScanlineOffsets(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(offsets) != 10 || offsets[0] != 128 {
+			t.Fatalf("%T: unexpected offsets %v", m, offsets)
+		}
+		img, err := DecodeRows(bytes.NewReader(data), offsets, 3, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b != image.Rect(0, 3, 7, 6) {
+			t.Fatalf("%T: bounds %v", m, b)
+		}
+		for y := 3; y < 6; y++ {
+			for x := 0; x < 7; x++ {
+				if !sameColor(img.At(x, y), m.At(x, y)) {
+					t.Fatalf("%T: pixel (%d,%d) = %v, want %v", m, x, y, img.At(x, y), m.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestDecodePreview(t *testing.T) {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i), 0x40, uint8(255 - i), 0xff}
+	}
+	paletted := image.NewPaletted(image.Rect(2, 3, 9, 12), pal)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 5)
+	}
+	rgba := testRGBA(7, 9)
+
+	for _, m := range []image.Image{paletted, rgba} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		b := m.Bounds()
+		for _, rows := range []int{1, 4, 9, 20} {
+			img, err := DecodePreview(bytes.NewReader(data), rows)
+			if err != nil {
+				t.Fatalf("%T %d rows: %v", m, rows, err)
+			}
+			want := b
+			if rows < b.Dy() {
+				want.Max.Y = b.Min.Y + rows
+			}
+			if img.Bounds() != want {
+				t.Fatalf("%T %d rows: bounds %v, want %v", m, rows, img.Bounds(), want)
+			}
+			for y := want.Min.Y; y < want.Max.Y; y++ {
+				for x := want.Min.X; x < want.Max.X; x++ {
+					if !sameColor(img.At(x, y), m.At(x, y)) {
+						t.Fatalf("%T %d rows: pixel (%d,%d) = %v, want %v", m, rows, x, y, img.At(x, y), m.At(x, y))
+					}
+				}
+			}
+		}
+		// Only the first row of a truecolor image needs to be present.
+		if _, ok := m.(*image.RGBA); ok {
+			offsets, err := ScanlineOffsets(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecodePreview(bytes.NewReader(data[:offsets[1]]), 1); err != nil {
+				t.Errorf("truncated after the first row: %v", err)
+			}
+		}
+	}
+	if _, err := DecodePreview(bytes.NewReader(nil), 0); err == nil {
+		t.Error("expected error for 0 rows")
+	}
+}
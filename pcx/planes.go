@@ -0,0 +1,36 @@
+package pcx
+
+import (
+	"image"
+	"image/color"
+)
+
+// SplitPlanes returns the red, green and blue channels of m as separate
+// grayscale images with the bounds of m, followed by the alpha channel unless
+// m is fully opaque. The channels are alpha-premultiplied, as in the planes
+// of a 4-plane PCX image, so SplitPlanes of an *image.RGBA decoded from one
+// reproduces its planes exactly.
+func SplitPlanes(m image.Image) []*image.Gray {
+	b := m.Bounds()
+	planes := make([]*image.Gray, 4)
+	for i := range planes {
+		planes[i] = image.NewGray(b)
+	}
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		o := (y - b.Min.Y) * planes[0].Stride
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+			planes[0].Pix[o] = c.R
+			planes[1].Pix[o] = c.G
+			planes[2].Pix[o] = c.B
+			planes[3].Pix[o] = c.A
+			opaque = opaque && c.A == 0xff
+			o++
+		}
+	}
+	if opaque {
+		return planes[:3]
+	}
+	return planes
+}
@@ -0,0 +1,41 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSplitPlanes(t *testing.T) {
+	hdr := makeHeader(5, 8, 4, 2, image.Rect(3, 4, 5, 5))
+	line := []byte{1, 2, 3, 4, 5, 6, 0xff, 0x80}
+	data := append(hdr, rleLines(line)...)
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	planes := SplitPlanes(img)
+	if len(planes) != 4 {
+		t.Fatalf("got %d planes, want 4", len(planes))
+	}
+	for i, p := range planes {
+		if p.Bounds() != img.Bounds() {
+			t.Errorf("plane %d: bounds %v, want %v", i, p.Bounds(), img.Bounds())
+		}
+		if !bytes.Equal(p.Pix, line[2*i:2*i+2]) {
+			t.Errorf("plane %d = %v, want %v", i, p.Pix, line[2*i:2*i+2])
+		}
+	}
+
+	opaque := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	opaque.Set(0, 0, color.RGBA{1, 2, 3, 0xff})
+	opaque.Set(1, 0, color.RGBA{4, 5, 6, 0xff})
+	planes = SplitPlanes(opaque)
+	if len(planes) != 3 {
+		t.Fatalf("opaque image: got %d planes, want 3", len(planes))
+	}
+	if got := planes[1].Pix; !bytes.Equal(got, []byte{2, 5}) {
+		t.Errorf("green plane = %v", got)
+	}
+}
@@ -0,0 +1,223 @@
+package pcx
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+// DecodePaletted reads a PCX image from r and returns it as an
+// *image.Paletted. Paletted files are returned as decoded, while truecolor
+// and grayscale files are quantized to a palette of at most maxColors colors,
+// which must be between 1 and 256.
+func DecodePaletted(r io.Reader, maxColors int) (*image.Paletted, error) {
+	if maxColors < 1 || maxColors > 256 {
+		return nil, errors.New("pcx: maxColors must be between 1 and 256")
+	}
+	m, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := m.(*image.Paletted); ok {
+		return p, nil
+	}
+	return quantize(m, maxColors), nil
+}
+
+// DecodeIndexed reads a PCX image from r and returns it as an *image.Paletted
+// like DecodePaletted, but quantizes truecolor files in place: once the image
+// is decoded in full, the color indices are written over its pixels, so no
+// second pixel buffer is allocated. maxColors must be between 1 and 256.
+func DecodeIndexed(r io.Reader, maxColors int) (*image.Paletted, error) {
+	if maxColors < 1 || maxColors > 256 {
+		return nil, errors.New("pcx: maxColors must be between 1 and 256")
+	}
+	m, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	switch m := m.(type) {
+	case *image.Paletted:
+		return m, nil
+	case *image.RGBA:
+		return quantizeRGBA(m, maxColors), nil
+	}
+	return quantize(m, maxColors), nil
+}
+
+// quantizeRGBA maps m onto a palette of at most n colors chosen by median
+// cut, reusing the pixel buffer of m, which must not be used afterwards.
+func quantizeRGBA(m *image.RGBA, n int) *image.Paletted {
+	b := m.Bounds()
+	pal := medianCut(m, n)
+	index := make(map[color.RGBA]uint8)
+	w, h := b.Dx(), b.Dy()
+	pix := m.Pix
+	// The index of pixel i is written at offset i, which is never past the
+	// pixel's own offset, so every pixel is read before it is overwritten.
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := y*m.Stride + x*4
+			c := color.RGBA{pix[o], pix[o+1], pix[o+2], pix[o+3]}
+			i, ok := index[c]
+			if !ok {
+				i = uint8(pal.Index(c))
+				index[c] = i
+			}
+			pix[y*w+x] = i
+		}
+	}
+	return &image.Paletted{Pix: pix[:w*h], Stride: w, Rect: b, Palette: pal}
+}
+
+// DecodeWithHistogram reads a paletted PCX image from r and returns it with
+// the number of pixels using each of the 256 possible color indices. Truecolor
+// and grayscale files are an error.
+func DecodeWithHistogram(r io.Reader) (*image.Paletted, []int, error) {
+	m, err := Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, ok := m.(*image.Paletted)
+	if !ok {
+		return nil, nil, errors.New("pcx: image is not paletted")
+	}
+	hist := make([]int, 256)
+	b := p.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for _, v := range p.Pix[y*p.Stride : y*p.Stride+b.Dx()] {
+			hist[v]++
+		}
+	}
+	return p, hist, nil
+}
+
+// quantize maps m onto a palette of at most n colors chosen by median cut.
+func quantize(m image.Image, n int) *image.Paletted {
+	b := m.Bounds()
+	p := image.NewPaletted(b, medianCut(m, n))
+	draw.Draw(p, b, m, b.Min, draw.Src)
+	return p
+}
+
+// colorCount is a distinct color of an image and the number of pixels using
+// it.
+type colorCount struct {
+	c     [4]uint8 // R, G, B, A
+	count int
+}
+
+// medianCut returns a palette of at most n colors for m. It is deterministic:
+// the same image always yields the same palette.
+func medianCut(m image.Image, n int) color.Palette {
+	b := m.Bounds()
+	counts := make(map[[4]uint8]int)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			counts[[4]uint8{c.R, c.G, c.B, c.A}]++
+		}
+	}
+	colors := make([]colorCount, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, colorCount{c, count})
+	}
+	sortColors(colors, 0)
+
+	boxes := [][]colorCount{colors}
+	for len(boxes) < n {
+		// Split the box with the widest channel range at its median.
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			ch, r := widestChannel(box)
+			if r > bestRange {
+				best, bestCh, bestRange = i, ch, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sortColors(box, bestCh)
+		total := 0
+		for _, c := range box {
+			total += c.count
+		}
+		split, seen := 1, box[0].count
+		for split < len(box)-1 && seen+box[split].count <= total/2 {
+			seen += box[split].count
+			split++
+		}
+		boxes = append(boxes, box[split:])
+		boxes[best] = box[:split]
+	}
+
+	pal := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [4]int
+		total := 0
+		for _, c := range box {
+			for i := range sum {
+				sum[i] += int(c.c[i]) * c.count
+			}
+			total += c.count
+		}
+		if total == 0 {
+			continue
+		}
+		pal = append(pal, color.NRGBA{
+			R: uint8((sum[0] + total/2) / total),
+			G: uint8((sum[1] + total/2) / total),
+			B: uint8((sum[2] + total/2) / total),
+			A: uint8((sum[3] + total/2) / total),
+		})
+	}
+	return pal
+}
+
+// widestChannel returns the channel with the largest range of values in box
+// and that range.
+func widestChannel(box []colorCount) (int, int) {
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for _, c := range box {
+		for i, v := range c.c {
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+	ch, r := 0, 0
+	for i := range lo {
+		if d := int(hi[i]) - int(lo[i]); d > r {
+			ch, r = i, d
+		}
+	}
+	return ch, r
+}
+
+// sortColors orders colors by the given channel, breaking ties by the
+// remaining channels in order.
+func sortColors(colors []colorCount, ch int) {
+	sort.Slice(colors, func(i, j int) bool {
+		a, b := colors[i].c, colors[j].c
+		if a[ch] != b[ch] {
+			return a[ch] < b[ch]
+		}
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+}
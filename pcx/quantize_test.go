@@ -0,0 +1,145 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePaletted(t *testing.T) {
+	colors := []color.RGBA{
+		{0xff, 0, 0, 0xff},
+		{0, 0xff, 0, 0xff},
+		{0, 0, 0xff, 0xff},
+	}
+	m := image.NewRGBA(image.Rect(0, 0, 9, 9))
+	for i := 0; i < 81; i++ {
+		m.SetRGBA(i%9, i/9, colors[i%3])
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	p, err := DecodePaletted(bytes.NewReader(data), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Palette) != 3 {
+		t.Errorf("palette has %d colors, want 3", len(p.Palette))
+	}
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 9; x++ {
+			if !sameColor(p.At(x, y), m.At(x, y)) {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, p.At(x, y), m.At(x, y))
+			}
+		}
+	}
+
+	p, err = DecodePaletted(bytes.NewReader(data), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Palette) != 2 {
+		t.Errorf("palette has %d colors, want 2", len(p.Palette))
+	}
+
+	if _, err := DecodePaletted(bytes.NewReader(data), 0); err == nil {
+		t.Error("expected error for maxColors 0")
+	}
+}
+
+func TestDecodeWithHistogram(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 5, 3), color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % 5 / 2)
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	p, hist, err := DecodeWithHistogram(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 256 {
+		t.Fatalf("histogram has %d entries, want 256", len(hist))
+	}
+	// Each row holds indices 0, 0, 1, 1, 2; the padding byte is not counted.
+	for i, want := range []int{6, 6, 3, 0} {
+		if hist[i] != want {
+			t.Errorf("hist[%d] = %d, want %d", i, hist[i], want)
+		}
+	}
+	if !bytes.Equal(p.Pix, m.Pix) {
+		t.Errorf("pixels = %v, want %v", p.Pix, m.Pix)
+	}
+
+	buf.Reset()
+	if err := Encode(buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeWithHistogram(buf); err == nil {
+		t.Error("expected error for truecolor image")
+	}
+}
+
+func TestDecodeIndexed(t *testing.T) {
+	colors := []color.RGBA{
+		{0xff, 0, 0, 0xff},
+		{0, 0xff, 0, 0xff},
+		{0, 0, 0xff, 0xff},
+	}
+	m := image.NewRGBA(image.Rect(2, 1, 9, 6))
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			m.SetRGBA(x, y, colors[(x*y)%3])
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	p, err := DecodeIndexed(bytes.NewReader(data), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Palette) != 3 || p.Bounds() != b {
+		t.Errorf("got %d colors in %v, want 3 in %v", len(p.Palette), p.Bounds(), b)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !sameColor(p.At(x, y), m.At(x, y)) {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, p.At(x, y), m.At(x, y))
+			}
+		}
+	}
+
+	if p, err = DecodeIndexed(bytes.NewReader(data), 2); err != nil {
+		t.Fatal(err)
+	} else if len(p.Palette) != 2 {
+		t.Errorf("palette has %d colors, want 2", len(p.Palette))
+	}
+
+	// Paletted files are returned as decoded.
+	buf.Reset()
+	src := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White})
+	src.Pix[3] = 1
+	if err := Encode(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = DecodeIndexed(buf, 1); err != nil {
+		t.Fatal(err)
+	} else if len(p.Palette) != 256 || !bytes.Equal(p.Pix, src.Pix) {
+		t.Errorf("paletted file decoded with %d colors and pixels %v", len(p.Palette), p.Pix)
+	}
+
+	if _, err := DecodeIndexed(bytes.NewReader(data), 257); err == nil {
+		t.Error("expected error for maxColors 257")
+	}
+}
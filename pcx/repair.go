@@ -0,0 +1,59 @@
+package pcx
+
+import (
+	"image"
+	"io"
+)
+
+// Repairs reports the problems Repair found and corrected.
+type Repairs struct {
+	// Version is set if the header held an unknown version number.
+	Version bool
+	// BytesPerLine is set if the bytes per line were odd, which the
+	// specification forbids. Too few bytes per line for the width cannot be
+	// repaired and fail to decode.
+	BytesPerLine bool
+	// PaletteOffset is set if stray bytes preceded the extended palette.
+	PaletteOffset bool
+	// ShortPalette is set if the extended palette was cut short and has
+	// been padded with black.
+	ShortPalette bool
+	// Resolution is set if the header held a zero resolution, which has
+	// been replaced by the other resolution or, if both were zero,
+	// DefaultDPI.
+	Resolution bool
+}
+
+// Any reports whether any repair was applied.
+func (r Repairs) Any() bool {
+	return r.Version || r.BytesPerLine || r.PaletteOffset || r.ShortPalette || r.Resolution
+}
+
+// Repair decodes the PCX image in r as leniently as the decoder allows and
+// writes it to w as a clean, specification-conformant file that keeps any
+// alpha plane, any trailer chunks and the original resolution, unless it is
+// zero. It reports the problems found in the input, and fails if the input
+// cannot be decoded at all.
+func Repair(r io.Reader, w io.Writer) (Repairs, error) {
+	d, err := newDecoderWithOptions(r, &DecodeOptions{Trailer: true})
+	if err != nil {
+		return Repairs{}, err
+	}
+	img, err := d.decode()
+	if err != nil {
+		return Repairs{}, err
+	}
+	repairs := d.repairs
+	repairs.Version = !validVersion(d.version)
+	repairs.BytesPerLine = d.bytesPerLine&1 != 0
+	repairs.Resolution = d.horizDpi == 0 || d.vertDpi == 0
+	opts := &EncodeOptions{HorizDPI: d.horizDpi, VertDPI: d.vertDpi, Chunks: d.meta.Chunks}
+	if m, ok := img.(*image.RGBA); ok && !m.Opaque() {
+		// Keep the alpha plane that EncodeWithOptions would composite away.
+		if err := encodeRGBAPlanes(w, m, opts); err != nil {
+			return repairs, err
+		}
+		return repairs, writeTrailer(w, opts, 0)
+	}
+	return repairs, EncodeWithOptions(w, img, opts)
+}
@@ -0,0 +1,73 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	hdr := makeHeader(9, 8, 1, 3, image.Rect(0, 0, 3, 2))
+	data := append(hdr, rleLines([]byte{1, 2, 3}, []byte{4, 5, 6})...)
+	data = append(data, 0, paletteMagic)
+	for i := 0; i < 8; i++ {
+		data = append(data, uint8(i*10), uint8(i*20), uint8(i*30))
+	}
+
+	out := &bytes.Buffer{}
+	repairs, err := Repair(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Repairs{Version: true, BytesPerLine: true, PaletteOffset: true, ShortPalette: true, Resolution: true}
+	if repairs != want {
+		t.Errorf("repairs %+v, want %+v", repairs, want)
+	}
+
+	fixed := out.Bytes()
+	img, _, err := DecodeWithOptions(bytes.NewReader(fixed), &DecodeOptions{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(2, 1); c != (color.RGBA{60, 120, 180, 0xff}) {
+		t.Errorf("pixel (2,1) = %v", c)
+	}
+	repairs, err = Repair(bytes.NewReader(fixed), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repairs.Any() {
+		t.Errorf("repaired file still needs repairs %+v", repairs)
+	}
+	if dpi := int(fixed[12]) | int(fixed[13])<<8; dpi != DefaultDPI {
+		t.Errorf("zero resolution repaired as %d dpi, want %d", dpi, DefaultDPI)
+	}
+}
+
+func TestRepairKeepsAlphaAndChunks(t *testing.T) {
+	hdr := makeHeader(9, 8, 4, 2, image.Rect(0, 0, 2, 1))
+	data := append(hdr, rleLines([]byte{10, 20}, []byte{30, 40}, []byte{50, 60}, []byte{0x80, 0xff})...)
+	data = appendChunk(data, [4]byte{'T', 'E', 'S', 'T'}, []byte("kept"))
+
+	out := &bytes.Buffer{}
+	repairs, err := Repair(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repairs.Version {
+		t.Errorf("repairs %+v, want Version", repairs)
+	}
+	img, meta, err := DecodeWithOptions(out, &DecodeOptions{Strict: true, Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, want := range []color.RGBA{{10, 30, 50, 0x80}, {20, 40, 60, 0xff}} {
+		if c := img.At(x, 0); c != want {
+			t.Errorf("pixel %d = %v, want %v", x, c, want)
+		}
+	}
+	if len(meta.Chunks) != 1 || string(meta.Chunks[0].Data) != "kept" {
+		t.Errorf("chunks = %v, want the TEST chunk", meta.Chunks)
+	}
+}
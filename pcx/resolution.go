@@ -0,0 +1,50 @@
+package pcx
+
+import "math"
+
+// A Resolution is a print resolution. PCX stores whole dots per inch, so
+// other resolutions are rounded when written.
+type Resolution float64
+
+// cmPerInch is the number of centimeters in an inch.
+const cmPerInch = 2.54
+
+// DPI returns a Resolution of d dots per inch.
+func DPI(d float64) Resolution {
+	return Resolution(d)
+}
+
+// DPCM returns a Resolution of d dots per centimeter.
+func DPCM(d float64) Resolution {
+	return Resolution(d * cmPerInch)
+}
+
+// DPI returns the resolution in dots per inch.
+func (r Resolution) DPI() float64 {
+	return float64(r)
+}
+
+// DPCM returns the resolution in dots per centimeter.
+func (r Resolution) DPCM() float64 {
+	return float64(r) / cmPerInch
+}
+
+// header returns the resolution as stored in a header: rounded to the
+// nearest whole dots per inch and clamped to the range of the field. Any
+// positive resolution stores as at least 1, since 0 means unset.
+func (r Resolution) header() int {
+	d := math.Round(float64(r))
+	switch {
+	case d < 1:
+		return 1
+	case d > 0xffff:
+		return 0xffff
+	}
+	return int(d)
+}
+
+// Resolution returns the horizontal and vertical resolution stored in the
+// header.
+func (m *Metadata) Resolution() (horiz, vert Resolution) {
+	return Resolution(m.Header.HorizDPI), Resolution(m.Header.VertDPI)
+}
@@ -0,0 +1,43 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestResolution(t *testing.T) {
+	if r := DPCM(118.11); math.Abs(r.DPI()-300) > 0.01 {
+		t.Errorf("118.11 dpcm = %v dpi, want 300", r.DPI())
+	}
+	if d := DPI(254).DPCM(); math.Abs(d-100) > 1e-9 {
+		t.Errorf("254 dpi = %v dpcm, want 100", d)
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for _, tc := range []struct {
+		opts        *EncodeOptions
+		horiz, vert int
+	}{
+		{&EncodeOptions{HorizResolution: DPI(71.5)}, 72, 72},
+		{&EncodeOptions{HorizResolution: DPI(72.49)}, 72, 72},
+		{&EncodeOptions{HorizResolution: DPCM(40), VertResolution: DPCM(40)}, 102, 102},
+		{&EncodeOptions{HorizResolution: DPI(0.2)}, 1, 1},
+		{&EncodeOptions{HorizResolution: DPI(1e6)}, 0xffff, 0xffff},
+		{&EncodeOptions{HorizDPI: 72, VertDPI: 72, VertResolution: DPI(144)}, 72, 144},
+	} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		_, meta, err := DecodeWithOptions(buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, v := meta.Resolution()
+		if h.DPI() != float64(tc.horiz) || v.DPI() != float64(tc.vert) {
+			t.Errorf("%+v: decoded %vx%v DPI, want %dx%d", tc.opts, h, v, tc.horiz, tc.vert)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestDecodeRGBA64(t *testing.T) {
+	c := color.RGBA{0x80, 0xff, 0, 0xff}
+	rgba := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	rgba.Set(1, 1, c)
+	paletted := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, c})
+	paletted.SetColorIndex(1, 1, 1)
+
+	for _, m := range []image.Image{rgba, paletted} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		for _, gamma := range []float64{1, 2.2} {
+			out, err := DecodeRGBA64(bytes.NewReader(buf.Bytes()), gamma)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := color.RGBA64{
+				R: uint16(math.Pow(0x80/255.0, gamma)*0xffff + 0.5),
+				G: 0xffff,
+				B: 0,
+				A: 0xffff,
+			}
+			if gamma == 1 && want.R != 0x8080 {
+				t.Fatalf("gamma 1 expanded 0x80 to %#x", want.R)
+			}
+			if got := out.RGBA64At(1, 1); got != want {
+				t.Errorf("%T gamma %v: got %v, want %v", m, gamma, got, want)
+			}
+			if got := out.RGBA64At(0, 0); got != (color.RGBA64{A: 0xffff}) {
+				t.Errorf("%T gamma %v: black decoded as %v", m, gamma, got)
+			}
+		}
+	}
+
+	if _, err := DecodeRGBA64(bytes.NewReader(nil), 0); err == nil {
+		t.Error("expected error for zero gamma")
+	}
+}
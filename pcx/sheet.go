@@ -0,0 +1,63 @@
+package pcx
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// SheetOptions controls the layout of EncodeSheet.
+type SheetOptions struct {
+	// Padding is the number of pixels between adjacent tiles and around the
+	// edge of the sheet.
+	Padding int
+
+	// Background fills the padding and the cells not covered by smaller
+	// images. The default is black.
+	Background color.Color
+}
+
+// EncodeSheet arranges imgs in a grid of cols columns, left to right and top
+// to bottom, and writes the composite to w as a single 24-bit PCX image.
+// Every cell is as large as the largest image, which is placed at its top
+// left. A nil opts is equivalent to the zero SheetOptions.
+func EncodeSheet(w io.Writer, imgs []image.Image, cols int, opts *SheetOptions) error {
+	if len(imgs) == 0 || cols < 1 {
+		return errors.New("pcx: sprite sheet needs at least one image and column")
+	}
+	if opts == nil {
+		opts = &SheetOptions{}
+	}
+	if opts.Padding < 0 {
+		return errors.New("pcx: negative sprite sheet padding")
+	}
+	var cell image.Point
+	for _, m := range imgs {
+		s := m.Bounds().Size()
+		if s.X > cell.X {
+			cell.X = s.X
+		}
+		if s.Y > cell.Y {
+			cell.Y = s.Y
+		}
+	}
+	if cols > len(imgs) {
+		cols = len(imgs)
+	}
+	rows := (len(imgs) + cols - 1) / cols
+	pad := opts.Padding
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*(cell.X+pad)+pad, rows*(cell.Y+pad)+pad))
+	bg := opts.Background
+	if bg == nil {
+		bg = color.Black
+	}
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	for i, m := range imgs {
+		min := image.Pt(pad+(i%cols)*(cell.X+pad), pad+(i/cols)*(cell.Y+pad))
+		b := m.Bounds()
+		draw.Draw(sheet, image.Rectangle{min, min.Add(b.Size())}, m, b.Min, draw.Over)
+	}
+	return Encode(w, sheet)
+}
@@ -0,0 +1,67 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeSheet(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	bg := color.RGBA{0, 0x80, 0, 0xff}
+	a := image.NewUniform(red)
+	imgs := []image.Image{
+		image.NewRGBA(image.Rect(0, 0, 4, 2)),
+		image.NewPaletted(image.Rect(5, 5, 7, 8), color.Palette{blue}),
+		image.NewRGBA(image.Rect(0, 0, 1, 1)),
+	}
+	for _, m := range []*image.RGBA{imgs[0].(*image.RGBA), imgs[2].(*image.RGBA)} {
+		for i := range m.Pix {
+			m.Pix[i] = 0
+		}
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				m.Set(x, y, a.C)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeSheet(&buf, imgs, 2, &SheetOptions{Padding: 1, Background: bg}); err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cells are 4x3 with 1 pixel of padding: 2 columns, 2 rows.
+	if got := sheet.Bounds().Size(); got != image.Pt(11, 9) {
+		t.Fatalf("sheet size %v, want (11,9)", got)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.Color
+	}{
+		{0, 0, bg},
+		{1, 1, red},  // first image
+		{4, 2, red},  // first image, bottom right
+		{1, 3, bg},   // below the first image within its cell
+		{6, 1, blue}, // second image
+		{7, 3, blue}, // second image, bottom right
+		{8, 1, bg},   // right of the second image within its cell
+		{1, 5, red},  // third image on the second row
+		{10, 8, bg},  // empty fourth cell
+		{5, 1, bg},   // padding between columns
+	} {
+		if c := sheet.At(tc.x, tc.y); !sameColor(c, tc.want) {
+			t.Errorf("pixel (%d, %d) = %v, want %v", tc.x, tc.y, c, tc.want)
+		}
+	}
+
+	if err := EncodeSheet(&buf, nil, 1, nil); err == nil {
+		t.Error("expected error for no images")
+	}
+}
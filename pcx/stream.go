@@ -0,0 +1,189 @@
+package pcx
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Encoder writes a 24-bit PCX image one scanline at a time, so that the whole
+// image never has to be held in memory.
+type Encoder struct {
+	w      io.Writer
+	opts   *EncodeOptions
+	bounds image.Rectangle
+	bg     color.RGBA64
+	lines  [3]*rleBuffer
+	y      int // rows written
+	err    error
+}
+
+// NewEncoder writes the header of a width by height 24-bit image to w and
+// returns an Encoder for its rows. A nil opts is equivalent to the zero
+// EncodeOptions. Since the rows are not known in advance, CompressionAuto
+// is treated as CompressionRLE.
+func NewEncoder(w io.Writer, width, height int, opts *EncodeOptions) (*Encoder, error) {
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return nil, fmt.Errorf("pcx: invalid image size %dx%d", width, height)
+	}
+	o := EncodeOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	if o.Compression == CompressionAuto {
+		o.Compression = CompressionRLE
+	}
+	e := &Encoder{w: w, opts: &o, bounds: image.Rect(0, 0, width, height), bg: o.background()}
+	for i := range e.lines {
+		e.lines[i] = o.newLine(width)
+	}
+	if err := writeHeader(w, 8, 3, width+width&1, e.bounds, nil, paletteInfoColor, &o); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// WriteRow encodes the next scanline. pix holds its pixels in the layout of
+// image.RGBA's Pix: four bytes of alpha-premultiplied red, green, blue and
+// alpha per pixel.
+func (e *Encoder) WriteRow(pix []byte) error {
+	if e.err != nil {
+		return e.err
+	}
+	width := e.bounds.Dx()
+	switch {
+	case e.y == e.bounds.Dy():
+		return errors.New("pcx: too many rows written")
+	case len(pix) < 4*width:
+		return errors.New("pcx: short row")
+	}
+	for _, l := range e.lines {
+		l.reset()
+	}
+	for x := 0; x < width; x++ {
+		o := e.opts.column(x, width) * 4
+		if pix[o+3] == 0xff {
+			e.lines[0].put(pix[o])
+			e.lines[1].put(pix[o+1])
+			e.lines[2].put(pix[o+2])
+			continue
+		}
+		r, g, b := flatten(uint32(pix[o])*0x101, uint32(pix[o+1])*0x101, uint32(pix[o+2])*0x101, uint32(pix[o+3])*0x101, e.bg)
+		e.lines[0].put(r)
+		e.lines[1].put(g)
+		e.lines[2].put(b)
+	}
+	for _, l := range e.lines {
+		if width&1 != 0 {
+			l.pad()
+		}
+		if _, err := e.w.Write(l.flush()); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	e.y++
+	return nil
+}
+
+// Flush flushes the underlying writer if it has a Flush method, as
+// *bufio.Writer does. Every row is fully encoded and passed to the underlying
+// writer by WriteRow, so the output always ends at a scanline boundary.
+func (e *Encoder) Flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	f, ok := e.w.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+	if err := f.Flush(); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
+
+// Close writes the trailer selected by the options. It fails if fewer rows
+// than the image height were written. Close does not close the underlying
+// writer.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.y != e.bounds.Dy() {
+		e.err = fmt.Errorf("pcx: %d of %d rows written", e.y, e.bounds.Dy())
+		return e.err
+	}
+	e.err = errors.New("pcx: encoder closed")
+	return writeTrailer(e.w, e.opts, 0)
+}
+
+// ReorderEncoder accepts the rows of an Encoder in any order within a window
+// of consecutive rows, buffering them until they can be written in sequence.
+// It suits producers such as tiled renderers that finish rows slightly out of
+// order.
+type ReorderEncoder struct {
+	e       *Encoder
+	window  int
+	pending map[int][]byte
+}
+
+// NewReorderEncoder returns a ReorderEncoder that writes to e and buffers at
+// most window rows.
+func NewReorderEncoder(e *Encoder, window int) *ReorderEncoder {
+	if window < 1 {
+		window = 1
+	}
+	return &ReorderEncoder{e: e, window: window, pending: make(map[int][]byte)}
+}
+
+// WriteRow accepts row y, in the layout of Encoder.WriteRow, and writes it
+// along with any buffered rows that follow it once all preceding rows have
+// been written. It fails if y is not within window rows of the first
+// unwritten row.
+func (r *ReorderEncoder) WriteRow(y int, pix []byte) error {
+	next := r.e.y
+	_, buffered := r.pending[y]
+	switch {
+	case y < next || buffered:
+		return fmt.Errorf("pcx: row %d already written", y)
+	case y >= next+r.window:
+		return fmt.Errorf("pcx: row %d outside reorder window starting at row %d", y, next)
+	case y >= r.e.bounds.Dy():
+		return fmt.Errorf("pcx: row %d out of bounds", y)
+	case len(pix) < 4*r.e.bounds.Dx():
+		return errors.New("pcx: short row")
+	}
+	if y != next {
+		r.pending[y] = append([]byte(nil), pix...)
+		return nil
+	}
+	if err := r.e.WriteRow(pix); err != nil {
+		return err
+	}
+	for {
+		pix, ok := r.pending[r.e.y]
+		if !ok {
+			return nil
+		}
+		delete(r.pending, r.e.y)
+		if err := r.e.WriteRow(pix); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the underlying Encoder. It fails if any rows are still
+// buffered, waiting for a preceding row.
+func (r *ReorderEncoder) Close() error {
+	if len(r.pending) != 0 {
+		return fmt.Errorf("pcx: row %d never written", r.e.y)
+	}
+	return r.e.Close()
+}
@@ -0,0 +1,148 @@
+package pcx
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func testRGBA(width, height int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.Set(x, y, color.RGBA{uint8(x * 40), uint8(y * 40), uint8(x ^ y), 0xff})
+		}
+	}
+	return m
+}
+
+func TestStreamEncoder(t *testing.T) {
+	m := testRGBA(5, 4)
+	var want bytes.Buffer
+	if err := Encode(&want, m); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	e, err := NewEncoder(&got, 5, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 4; y++ {
+		if err := e.WriteRow(m.Pix[y*m.Stride:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.WriteRow(m.Pix); err == nil {
+		t.Error("expected error writing past the last row")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("streamed output differs from Encode")
+	}
+
+	e, err = NewEncoder(&got, 5, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err == nil {
+		t.Error("expected error closing with rows missing")
+	}
+}
+
+func TestStreamEncoderFlush(t *testing.T) {
+	m := testRGBA(5, 4)
+	var want bytes.Buffer
+	if err := Encode(&want, m); err != nil {
+		t.Fatal(err)
+	}
+	// Offsets of the scanlines within the complete file.
+	offsets, err := ScanlineOffsets(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	bw := bufio.NewWriterSize(&got, 4096)
+	e, err := NewEncoder(bw, 5, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 4; y++ {
+		if err := e.WriteRow(m.Pix[y*m.Stride:]); err != nil {
+			t.Fatal(err)
+		}
+		if y == 0 && got.Len() != 0 {
+			t.Fatal("output written before Flush")
+		}
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if n := int64(got.Len()); n != offsets[y+1] {
+			t.Errorf("after row %d flushed %d bytes, want %d", y, n, offsets[y+1])
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("flushed output differs from Encode")
+	}
+}
+
+func TestReorderEncoder(t *testing.T) {
+	m := testRGBA(3, 6)
+	var want bytes.Buffer
+	if err := Encode(&want, m); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	e, err := NewEncoder(&got, 3, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReorderEncoder(e, 3)
+	for _, y := range []int{1, 0, 2, 4, 3, 5} {
+		if err := r.WriteRow(y, m.Pix[y*m.Stride:]); err != nil {
+			t.Fatalf("row %d: %v", y, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("reordered output differs from Encode")
+	}
+
+	e, err = NewEncoder(&got, 3, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReorderEncoder(e, 3)
+	if err := r.WriteRow(3, m.Pix); err == nil {
+		t.Error("expected error for row outside the window")
+	}
+	if err := r.WriteRow(1, m.Pix); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteRow(1, m.Pix); err == nil {
+		t.Error("expected error for duplicate row")
+	}
+	if err := r.WriteRow(2, nil); err == nil {
+		t.Error("expected error for short buffered row")
+	}
+	if err := r.WriteRow(2, []byte{}); err == nil {
+		t.Error("expected error for empty buffered row")
+	}
+	if err := r.Close(); err == nil {
+		t.Error("expected error closing with buffered rows")
+	}
+}
@@ -0,0 +1,299 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// A Chunk is a tagged block of data stored after the pixel data and extended
+// palette of a PCX file. PCX itself defines no trailing data; the package
+// recognizes a trailer made up of chunks, each laid out as a 4 byte tag, the
+// little-endian 32-bit length of the data and the data itself.
+type Chunk struct {
+	Tag  [4]byte
+	Data []byte
+}
+
+// Chunk tags recognized by the package.
+var (
+	// ThumbnailTag marks a chunk holding a complete PCX file with a small
+	// preview of the image.
+	ThumbnailTag = [4]byte{'T', 'H', 'M', 'B'}
+
+	// PropertiesTag marks a chunk holding key/value pairs, each key and
+	// value stored as its uvarint length followed by its bytes, with keys in
+	// ascending order.
+	PropertiesTag = [4]byte{'P', 'R', 'O', 'P'}
+
+	// CyclesTag marks a chunk holding palette cycling ranges, each stored as
+	// its start and end index followed by its little-endian 16-bit rate.
+	CyclesTag = [4]byte{'C', 'Y', 'C', 'L'}
+
+	// TransparencyTag marks a chunk holding the single palette index that
+	// is transparent.
+	TransparencyTag = [4]byte{'T', 'R', 'N', 'S'}
+
+	// PaletteLengthTag marks a chunk holding the little-endian 16-bit number
+	// of colors of the palette before it was padded to 256 colors.
+	PaletteLengthTag = [4]byte{'P', 'L', 'E', 'N'}
+)
+
+// A CycleRange is a run of palette entries that are rotated to animate an
+// image. Rate is in the units of Deluxe Paint's CRNG chunk, where 16384
+// steps the colors 60 times per second; a rate of zero disables the range.
+type CycleRange struct {
+	Start, End uint8
+	Rate       uint16
+}
+
+// writeTrailer writes the chunks requested by the options after the image.
+// paletteLen is the number of colors of a paletted image, or 0.
+func writeTrailer(w io.Writer, opts *EncodeOptions, paletteLen int) error {
+	chunks := opts.Chunks[:len(opts.Chunks):len(opts.Chunks)]
+	if len(opts.Properties) != 0 {
+		chunks = append(chunks, Chunk{PropertiesTag, encodeProperties(opts.Properties)})
+	}
+	if len(opts.Cycles) != 0 {
+		chunks = append(chunks, Chunk{CyclesTag, encodeCycles(opts.Cycles)})
+	}
+	if opts.Transparent {
+		chunks = append(chunks, Chunk{TransparencyTag, []byte{opts.TransparentIndex}})
+	}
+	if paletteLen > 0 && paletteLen < 256 {
+		chunks = append(chunks, Chunk{PaletteLengthTag, []byte{byte(paletteLen), byte(paletteLen >> 8)}})
+	}
+	for _, c := range chunks {
+		var hdr [8]byte
+		copy(hdr[:4], c.Tag[:])
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(c.Data)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(c.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeProperties(props map[string]string) []byte {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	var n [binary.MaxVarintLen64]byte
+	for _, k := range keys {
+		for _, s := range []string{k, props[k]} {
+			b = append(b, n[:binary.PutUvarint(n[:], uint64(len(s)))]...)
+			b = append(b, s...)
+		}
+	}
+	return b
+}
+
+// parseProperties decodes the data of a PropertiesTag chunk, reporting false
+// if it is malformed.
+func parseProperties(b []byte) (map[string]string, bool) {
+	props := make(map[string]string)
+	for len(b) > 0 {
+		var kv [2]string
+		for i := range kv {
+			n, l := binary.Uvarint(b)
+			if l <= 0 || n > uint64(len(b)-l) {
+				return nil, false
+			}
+			kv[i] = string(b[l : l+int(n)])
+			b = b[l+int(n):]
+		}
+		props[kv[0]] = kv[1]
+	}
+	return props, true
+}
+
+func encodeCycles(cycles []CycleRange) []byte {
+	b := make([]byte, 4*len(cycles))
+	for i, c := range cycles {
+		b[i*4] = c.Start
+		b[i*4+1] = c.End
+		binary.LittleEndian.PutUint16(b[i*4+2:], c.Rate)
+	}
+	return b
+}
+
+// parseCycles decodes the data of a CyclesTag chunk, reporting false if it is
+// malformed.
+func parseCycles(b []byte) ([]CycleRange, bool) {
+	if len(b)%4 != 0 {
+		return nil, false
+	}
+	cycles := make([]CycleRange, len(b)/4)
+	for i := range cycles {
+		cycles[i] = CycleRange{b[i*4], b[i*4+1], binary.LittleEndian.Uint16(b[i*4+2:])}
+	}
+	return cycles, true
+}
+
+// parseChunks splits b into chunks, reporting false if b is not made up
+// entirely of well-formed chunks.
+func parseChunks(b []byte) ([]Chunk, bool) {
+	var chunks []Chunk
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(b[4:8])
+		if uint64(n) > uint64(len(b)-8) {
+			return nil, false
+		}
+		var c Chunk
+		copy(c.Tag[:], b[:4])
+		c.Data = b[8 : 8+n]
+		chunks = append(chunks, c)
+		b = b[8+n:]
+	}
+	return chunks, true
+}
+
+// hasExtendedPalette reports whether the pixel data is followed by a 256
+// color VGA palette, or may be for grayscale files with PreferPalette set.
+func (d *decoder) hasExtendedPalette() bool {
+	if d.preferPalette() {
+		return true
+	}
+	if d.grayscale {
+		return false
+	}
+	return (d.nplanes == 1 && d.bpp == 8) || (d.nplanes == 4 && d.bpp == 2)
+}
+
+// preferPalette reports whether an 8bpp single plane grayscale file is
+// decoded as paletted because of DecodeOptions.PreferPalette.
+func (d *decoder) preferPalette() bool {
+	return d.opts.PreferPalette && d.grayscale && d.bpp == 8 && d.nplanes == 1
+}
+
+// skipImage reads past the pixel data and extended palette without decoding
+// them.
+func (d *decoder) skipImage() error {
+	d.br = d.newByteReader(d.r)
+	for y := 0; y < d.bounds.Dy(); y++ {
+		if err := d.decodeScanline(d.br, nil); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	if d.hasExtendedPalette() {
+		return d.readExtendedPalette(d.br, make([]color.Color, 256))
+	}
+	return nil
+}
+
+// readTrailer reads everything following the image into the metadata.
+func (d *decoder) readTrailer() error {
+	trailer, err := io.ReadAll(d.br)
+	if err != nil {
+		return err
+	}
+	if d.limitReached() {
+		// The trailer may go on past the limit.
+		return ErrReadLimit
+	}
+	// Grayscale files may carry a redundant gray ramp extended palette.
+	if d.grayscale && !d.hasExtendedPalette() && len(trailer) >= 1+3*256 && trailer[0] == paletteMagic {
+		trailer = trailer[1+3*256:]
+	}
+	d.meta.Trailer = trailer
+	chunks, ok := parseChunks(trailer)
+	if !ok {
+		return nil
+	}
+	d.meta.Chunks = chunks
+	for _, c := range chunks {
+		switch c.Tag {
+		case PropertiesTag:
+			if props, ok := parseProperties(c.Data); ok {
+				d.meta.Properties = props
+			}
+		case CyclesTag:
+			if cycles, ok := parseCycles(c.Data); ok {
+				d.meta.Cycles = cycles
+			}
+		case TransparencyTag:
+			if len(c.Data) == 1 {
+				d.meta.Transparent = true
+				d.meta.TransparentIndex = c.Data[0]
+			}
+		case PaletteLengthTag:
+			if len(c.Data) == 2 {
+				d.meta.PaletteLength = int(binary.LittleEndian.Uint16(c.Data))
+			}
+		}
+	}
+	return nil
+}
+
+// applyPaletteLength truncates the palette of m to the length recorded in
+// the trailer, clamping any color indices past the new end.
+func (d *decoder) applyPaletteLength(m image.Image) {
+	p, ok := m.(*image.Paletted)
+	n := d.meta.PaletteLength
+	if !ok || n <= 0 || n >= len(p.Palette) {
+		return
+	}
+	p.Palette = p.Palette[:n:n]
+	for y := 0; y < p.Rect.Dy(); y++ {
+		row := p.Pix[y*p.Stride : y*p.Stride+p.Rect.Dx()]
+		for i, v := range row {
+			if int(v) >= n {
+				row[i] = uint8(n - 1)
+			}
+		}
+	}
+}
+
+// applyTransparency clears the alpha of the transparent palette entry of m.
+func (d *decoder) applyTransparency(m image.Image) {
+	p, ok := m.(*image.Paletted)
+	if !ok || !d.meta.Transparent || int(d.meta.TransparentIndex) >= len(p.Palette) {
+		return
+	}
+	c := color.NRGBAModel.Convert(p.Palette[d.meta.TransparentIndex]).(color.NRGBA)
+	c.A = 0
+	// The palette may be shared, so change a copy.
+	p.Palette = append(color.Palette(nil), p.Palette...)
+	p.Palette[d.meta.TransparentIndex] = c
+}
+
+// DecodeThumbnail decodes the preview image stored in a ThumbnailTag chunk
+// after the PCX image in r, without decoding the image itself. It reports
+// false if the file has no preview.
+func DecodeThumbnail(r io.Reader) (image.Image, bool, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := d.skipImage(); err != nil {
+		return nil, false, err
+	}
+	if err := d.readTrailer(); err != nil {
+		return nil, false, err
+	}
+	for _, c := range d.meta.Chunks {
+		if c.Tag == ThumbnailTag {
+			m, err := Decode(bytes.NewReader(c.Data))
+			if err != nil {
+				return nil, false, err
+			}
+			return m, true, nil
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,188 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"testing"
+)
+
+func appendChunk(b []byte, tag [4]byte, data []byte) []byte {
+	b = append(b, tag[:]...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(data)))
+	return append(b, data...)
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	main := image.NewPaletted(image.Rect(0, 0, 65, 33), pal)
+	thumb := image.NewPaletted(image.Rect(0, 0, 9, 5), pal)
+	thumb.Pix[3] = 1
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, main); err != nil {
+		t.Fatal(err)
+	}
+	plain := append([]byte{}, buf.Bytes()...)
+	if _, ok, err := DecodeThumbnail(bytes.NewReader(plain)); err != nil || ok {
+		t.Fatalf("expected no thumbnail, got ok=%v err=%v", ok, err)
+	}
+
+	thumbBuf := &bytes.Buffer{}
+	if err := Encode(thumbBuf, thumb); err != nil {
+		t.Fatal(err)
+	}
+	withThumb := appendChunk(plain, ThumbnailTag, thumbBuf.Bytes())
+	img, ok, err := DecodeThumbnail(bytes.NewReader(withThumb))
+	if err != nil || !ok {
+		t.Fatalf("expected thumbnail, got ok=%v err=%v", ok, err)
+	}
+	if b := img.Bounds(); b != thumb.Bounds() {
+		t.Fatalf("thumbnail bounds %v", b)
+	}
+	if !bytes.Equal(img.(*image.Paletted).Pix, thumb.Pix) {
+		t.Error("thumbnail pixels differ")
+	}
+
+	_, meta, err := DecodeWithOptions(bytes.NewReader(withThumb), &DecodeOptions{Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Chunks) != 1 || meta.Chunks[0].Tag != ThumbnailTag {
+		t.Errorf("unexpected chunks %v", meta.Chunks)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	props := map[string]string{
+		"colorspace": "Adobe RGB (1998)",
+		"author":     "",
+		"comment":    "multi\nline",
+	}
+	buf := &bytes.Buffer{}
+	opts := &EncodeOptions{
+		Chunks:     []Chunk{{Tag: [4]byte{'a', 'b', 'c', 'd'}, Data: []byte{1, 2}}},
+		Properties: props,
+	}
+	if err := EncodeWithOptions(buf, image.NewRGBA(image.Rect(0, 0, 3, 3)), opts); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := DecodeWithOptions(buf, &DecodeOptions{Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Chunks) != 2 || meta.Chunks[0].Tag != opts.Chunks[0].Tag || meta.Chunks[1].Tag != PropertiesTag {
+		t.Fatalf("unexpected chunks %v", meta.Chunks)
+	}
+	if len(meta.Properties) != len(props) {
+		t.Fatalf("decoded properties %v", meta.Properties)
+	}
+	for k, v := range props {
+		if meta.Properties[k] != v {
+			t.Errorf("property %q = %q, want %q", k, meta.Properties[k], v)
+		}
+	}
+}
+
+func TestCycles(t *testing.T) {
+	cycles := []CycleRange{{Start: 16, End: 31, Rate: 16384}, {Start: 200, End: 210, Rate: 0}}
+	m := image.NewPaletted(image.Rect(0, 0, 2, 2), palette.Plan9)
+	buf := &bytes.Buffer{}
+	if err := EncodeWithOptions(buf, m, &EncodeOptions{Cycles: cycles}); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := DecodeWithOptions(buf, &DecodeOptions{Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Cycles) != len(cycles) {
+		t.Fatalf("decoded cycles %v", meta.Cycles)
+	}
+	for i, c := range cycles {
+		if meta.Cycles[i] != c {
+			t.Errorf("cycle %d = %v, want %v", i, meta.Cycles[i], c)
+		}
+	}
+}
+
+func TestTransparency(t *testing.T) {
+	pal := color.Palette{color.Black, color.RGBA{0xff, 0, 0xff, 0xff}, color.White}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 1), pal)
+	m.Pix = []uint8{0, 1, 2}
+	buf := &bytes.Buffer{}
+	if err := EncodeWithOptions(buf, m, &EncodeOptions{Transparent: true, TransparentIndex: 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Transparency: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Transparent || meta.TransparentIndex != 1 {
+		t.Errorf("transparent index %t %d, want 1", meta.Transparent, meta.TransparentIndex)
+	}
+	if c := img.At(1, 0); c != (color.NRGBA{0xff, 0, 0xff, 0}) {
+		t.Errorf("transparent pixel = %v", c)
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("opaque pixel has alpha %#x", a)
+	}
+
+	// Without the option the palette is left alone.
+	img, err = Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := img.At(1, 0).RGBA(); a != 0xffff {
+		t.Errorf("pixel has alpha %#x without Transparency", a)
+	}
+}
+
+func TestKeepPaletteLength(t *testing.T) {
+	pal := color.Palette{color.Black, color.RGBA{0x10, 0x20, 0x30, 0xff}, color.White}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), pal)
+	m.Pix = []uint8{0, 1, 2, 2, 1, 0}
+	for _, keep := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		if err := EncodeWithOptions(buf, m, &EncodeOptions{KeepPaletteLength: keep}); err != nil {
+			t.Fatal(err)
+		}
+		img, meta, err := DecodeWithOptions(buf, &DecodeOptions{Trailer: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := img.(*image.Paletted)
+		want := 256
+		if keep {
+			want = len(pal)
+		}
+		if len(p.Palette) != want {
+			t.Errorf("keep %t: palette length %d, want %d", keep, len(p.Palette), want)
+		}
+		if keep && meta.PaletteLength != len(pal) {
+			t.Errorf("recorded palette length %d", meta.PaletteLength)
+		}
+		if !bytes.Equal(p.Pix, m.Pix) {
+			t.Errorf("keep %t: indices %v, want %v", keep, p.Pix, m.Pix)
+		}
+	}
+
+	// A translucent palette written as RGBA by PaletteAlpha has no palette
+	// length to keep.
+	m.Palette = color.Palette{color.Black, color.NRGBA{0x10, 0x20, 0x30, 0x80}, color.White}
+	buf := &bytes.Buffer{}
+	if err := EncodeWithOptions(buf, m, &EncodeOptions{KeepPaletteLength: true, PaletteAlpha: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := DecodeWithOptions(buf, &DecodeOptions{Trailer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.PaletteLength != 0 {
+		t.Errorf("RGBA image recorded palette length %d", meta.PaletteLength)
+	}
+}
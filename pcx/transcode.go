@@ -0,0 +1,27 @@
+package pcx
+
+import (
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// TranscodeToPNG decodes the PCX image in r and writes it to w as a PNG.
+func TranscodeToPNG(w io.Writer, r io.Reader) error {
+	m, err := Decode(r)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, m)
+}
+
+// TranscodeToJPEG decodes the PCX image in r and writes it to w as a JPEG
+// with the given options. Paletted images are flattened to RGB and any alpha
+// channel is discarded. A nil o uses the default quality.
+func TranscodeToJPEG(w io.Writer, r io.Reader, o *jpeg.Options) error {
+	m, err := Decode(r)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, m, o)
+}
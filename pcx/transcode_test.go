@@ -0,0 +1,41 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 9, 7), color.Palette{color.Black, color.White})
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i & 1)
+	}
+	src := &bytes.Buffer{}
+	if err := Encode(src, m); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := TranscodeToPNG(out, bytes.NewReader(src.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := png.DecodeConfig(out); err != nil {
+		t.Fatal(err)
+	} else if cfg.Width != 9 || cfg.Height != 7 {
+		t.Errorf("PNG size %dx%d", cfg.Width, cfg.Height)
+	}
+
+	out.Reset()
+	if err := TranscodeToJPEG(out, bytes.NewReader(src.Bytes()), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := jpeg.DecodeConfig(out); err != nil {
+		t.Fatal(err)
+	} else if cfg.Width != 9 || cfg.Height != 7 {
+		t.Errorf("JPEG size %dx%d", cfg.Width, cfg.Height)
+	}
+}
@@ -0,0 +1,67 @@
+package pcx
+
+import (
+	"image"
+	"image/color"
+)
+
+// trim crops the uniform border of m as requested by DecodeOptions.AutoTrim
+// and records the bounds kept. Images without a SubImage method are returned
+// whole.
+func (d *decoder) trim(m image.Image) image.Image {
+	b := m.Bounds()
+	d.meta.Trim = b
+	if b.Empty() {
+		return m
+	}
+	c := d.opts.TrimColor
+	if c == nil {
+		c = m.At(b.Min.X, b.Min.Y)
+		for _, p := range []image.Point{{b.Max.X - 1, b.Min.Y}, {b.Min.X, b.Max.Y - 1}, {b.Max.X - 1, b.Max.Y - 1}} {
+			if !sameRGBA(m.At(p.X, p.Y), c) {
+				return m
+			}
+		}
+	}
+	r := trimBounds(m, c)
+	s, ok := m.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return m
+	}
+	d.meta.Trim = r
+	return s.SubImage(r)
+}
+
+// trimBounds returns the smallest rectangle of m outside of which every pixel
+// is c.
+func trimBounds(m image.Image, c color.Color) image.Rectangle {
+	b := m.Bounds()
+	uniform := func(x0, y0, x1, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				if !sameRGBA(m.At(x, y), c) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for b.Min.Y < b.Max.Y && uniform(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+1) {
+		b.Min.Y++
+	}
+	if b.Empty() {
+		return image.Rectangle{}
+	}
+	for uniform(b.Min.X, b.Max.Y-1, b.Max.X, b.Max.Y) {
+		b.Max.Y--
+	}
+	for uniform(b.Min.X, b.Min.Y, b.Min.X+1, b.Max.Y) {
+		b.Min.X++
+	}
+	for uniform(b.Max.X-1, b.Min.Y, b.Max.X, b.Max.Y) {
+		b.Max.X--
+	}
+	return b
+}
@@ -0,0 +1,70 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeAutoTrim(t *testing.T) {
+	white := color.Gray{0xff}
+	m := image.NewGray(image.Rect(0, 0, 8, 6))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	m.SetGray(2, 1, color.Gray{0})
+	m.SetGray(5, 3, color.Gray{0x80})
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, c := range []color.Color{nil, white} {
+		img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{AutoTrim: true, TrimColor: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := image.Rect(2, 1, 6, 4)
+		if img.Bounds() != want || meta.Trim != want {
+			t.Errorf("TrimColor %v: bounds %v, trim %v, want %v", c, img.Bounds(), meta.Trim, want)
+		}
+		if got := img.At(5, 3); got != (color.Gray{0x80}) {
+			t.Errorf("TrimColor %v: pixel = %v", c, got)
+		}
+	}
+
+	// A border of another color is left alone.
+	img, meta, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{AutoTrim: true, TrimColor: color.Black})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != m.Bounds() || meta.Trim != m.Bounds() {
+		t.Errorf("black border: bounds %v, trim %v", img.Bounds(), meta.Trim)
+	}
+
+	// Corners that disagree give no border color.
+	m.SetGray(7, 5, color.Gray{0})
+	buf.Reset()
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if img, _, err := DecodeWithOptions(&buf, &DecodeOptions{AutoTrim: true}); err != nil || img.Bounds() != m.Bounds() {
+		t.Errorf("mixed corners: bounds %v, err %v", img.Bounds(), err)
+	}
+
+	// An image that is all border trims to nothing.
+	blank := image.NewGray(image.Rect(0, 0, 3, 3))
+	buf.Reset()
+	if err := Encode(&buf, blank); err != nil {
+		t.Fatal(err)
+	}
+	img, meta, err = DecodeWithOptions(&buf, &DecodeOptions{AutoTrim: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.Bounds().Empty() || !meta.Trim.Empty() {
+		t.Errorf("blank image: bounds %v, trim %v", img.Bounds(), meta.Trim)
+	}
+}
@@ -0,0 +1,55 @@
+package pcx
+
+// Variant describes a combination of PCX header fields, identifying a pixel
+// layout the package can read or write.
+type Variant struct {
+	BitsPerPixel int
+	Planes       int
+	Grayscale    bool // palette info 2, pixels are gray levels
+	Compression  Compression
+}
+
+// decodeLayouts are the layouts handled by decodeImage.
+var decodeLayouts = []Variant{
+	{BitsPerPixel: 8, Planes: 1, Grayscale: true},
+	{BitsPerPixel: 1, Planes: 1},
+	{BitsPerPixel: 2, Planes: 1},
+	{BitsPerPixel: 4, Planes: 1},
+	{BitsPerPixel: 8, Planes: 1},
+	{BitsPerPixel: 8, Planes: 3},
+	{BitsPerPixel: 8, Planes: 4},
+	{BitsPerPixel: 1, Planes: 2},
+	{BitsPerPixel: 1, Planes: 3},
+	{BitsPerPixel: 1, Planes: 4},
+	{BitsPerPixel: 2, Planes: 4},
+}
+
+// SupportedDecodeVariants returns the variants Decode can read.
+func SupportedDecodeVariants() []Variant {
+	var vs []Variant
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		for _, v := range decodeLayouts {
+			v.Compression = c
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// SupportedEncodeVariants returns the variants written by Encode and
+// EncodeWithOptions, followed by those only written by EncodeLegacy.
+func SupportedEncodeVariants() []Variant {
+	var vs []Variant
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		vs = append(vs,
+			Variant{BitsPerPixel: 8, Planes: 1, Grayscale: true, Compression: c}, // *image.Gray
+			Variant{BitsPerPixel: 8, Planes: 1, Compression: c},                  // paletted images
+			Variant{BitsPerPixel: 8, Planes: 3, Compression: c},                  // everything else
+			Variant{BitsPerPixel: 4, Planes: 1, Compression: c},                  // EncodeOptions.HeaderPalette
+			Variant{BitsPerPixel: 8, Planes: 4, Compression: c},                  // EncodeOptions.PaletteAlpha
+		)
+	}
+	return append(vs,
+		Variant{BitsPerPixel: 1, Planes: 4, Compression: CompressionRLE},
+	)
+}
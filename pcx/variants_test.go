@@ -0,0 +1,94 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSupportedDecodeVariants(t *testing.T) {
+	supported := make(map[Variant]bool)
+	for _, v := range SupportedDecodeVariants() {
+		supported[v] = true
+	}
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		for _, gray := range []bool{false, true} {
+			for nplanes := 1; nplanes <= 4; nplanes++ {
+				for bpp := 1; bpp <= 8; bpp++ {
+					v := Variant{BitsPerPixel: bpp, Planes: nplanes, Grayscale: gray, Compression: c}
+					bytesPerLine := 2 * bpp
+					hdr := makeHeader(5, bpp, nplanes, bytesPerLine, image.Rect(0, 0, 16, 1))
+					if gray {
+						hdr[68] = 2
+					}
+					line := make([]byte, bytesPerLine*nplanes)
+					data := append(hdr, rleLines(line)...)
+					if c == CompressionNone {
+						hdr[2] = 0
+						data = append(hdr, line...)
+					}
+					data = append(data, paletteMagic)
+					data = append(data, make([]byte, 3*256)...)
+					_, err := Decode(bytes.NewReader(data))
+					if got := err == nil; got != supported[v] {
+						t.Errorf("%+v: decode error %v, listed %t", v, err, supported[v])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSupportedEncodeVariants(t *testing.T) {
+	b := image.Rect(0, 0, 4, 2)
+	pal := color.Palette{color.Black, color.White}
+	written := make(map[Variant]bool)
+	add := func(data []byte) {
+		v := Variant{BitsPerPixel: int(data[3]), Planes: int(data[65]), Grayscale: data[68] == 2}
+		if data[2] == 0 {
+			v.Compression = CompressionNone
+		}
+		written[v] = true
+	}
+	for _, c := range []Compression{CompressionRLE, CompressionNone} {
+		for _, m := range []image.Image{image.NewGray(b), image.NewPaletted(b, pal), image.NewRGBA(b), image.NewNRGBA(b)} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, m, &EncodeOptions{Compression: c}); err != nil {
+				t.Fatal(err)
+			}
+			add(buf.Bytes())
+		}
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, image.NewPaletted(b, pal), &EncodeOptions{Compression: c, HeaderPalette: true}); err != nil {
+			t.Fatal(err)
+		}
+		add(buf.Bytes())
+		buf.Reset()
+		sprite := image.NewPaletted(b, color.Palette{color.Black, color.Transparent})
+		if err := EncodeWithOptions(&buf, sprite, &EncodeOptions{Compression: c, PaletteAlpha: true}); err != nil {
+			t.Fatal(err)
+		}
+		add(buf.Bytes())
+	}
+	var buf bytes.Buffer
+	if err := EncodeRGBAWithMask(&buf, image.NewRGBA(b), image.NewGray(b)); err != nil {
+		t.Fatal(err)
+	}
+	add(buf.Bytes())
+	buf.Reset()
+	if err := EncodeLegacy(&buf, image.NewPaletted(b, pal)); err != nil {
+		t.Fatal(err)
+	}
+	add(buf.Bytes())
+
+	listed := SupportedEncodeVariants()
+	if len(listed) != len(written) {
+		t.Errorf("%d variants listed, %d written", len(listed), len(written))
+	}
+	for _, v := range listed {
+		if !written[v] {
+			t.Errorf("%+v listed but not written", v)
+		}
+	}
+}